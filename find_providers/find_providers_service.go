@@ -3,15 +3,17 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"find_providers/pkg/config"
+	"find_providers/pkg/maddr"
 	"find_providers/pkg/model"
 	"find_providers/pkg/providers"
-	"flag"
 	"fmt"
 	"github.com/gorilla/mux"
 	cid2 "github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
 	"net/http"
 	"time"
 )
@@ -21,8 +23,12 @@ var kad *dht.IpfsDHT
 func main() {
 	//logging.SetAllLoggers(logging.LevelDebug)
 
-	port := flag.Int("port", 10000, "Port of the service")
-	flag.Parse()
+	conf := config.Default()
+	config.RegisterFlags(pflag.CommandLine, conf)
+	pflag.Parse()
+	if err := config.Load(&conf, pflag.CommandLine, config.Config.ValidateService); err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
 
 	h, err := libp2p.New()
 	if err != nil {
@@ -49,8 +55,8 @@ func main() {
 	router.HandleFunc("/findProviders/{cid}", findProviders)
 	router.HandleFunc("/findAllProviders/{cid}", findAllProviders)
 
-	log.Infoln("Running on port ", *port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), router))
+	log.Infoln("Running on port ", conf.Services.Port)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", conf.Services.Port), router))
 }
 
 // findProviders finds the provider records of a given CID
@@ -84,6 +90,7 @@ func findProviders(w http.ResponseWriter, r *http.Request) {
 				for j, _m := range _p.Addrs {
 					pstr.MAddrs[j] = _m.String()
 				}
+				maddr.ClassifyProvider(&pstr)
 				ans.Providers[i] = pstr
 			}
 
@@ -122,6 +129,7 @@ func findAllProviders(w http.ResponseWriter, r *http.Request) {
 			for j, _m := range _p.Provider.Addrs {
 				pstr.MAddrs[j] = _m.String()
 			}
+			maddr.ClassifyProvider(&pstr)
 			ans.Providers[i] = pstr
 		}
 
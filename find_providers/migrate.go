@@ -0,0 +1,86 @@
+package main
+
+import (
+	"find_providers/pkg/config"
+	"find_providers/pkg/db"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+// migrate migrates the schema of the postgres database to the version of the binary (up), reverts its last
+// migrations (down) or lists the migrations and when they were applied (status)
+func main() {
+	steps := pflag.Int("steps", 1, "how many migrations down reverts")
+	conf := config.Default()
+	config.RegisterFlags(pflag.CommandLine, conf)
+	pflag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: migrate [flags] up|down|status")
+		pflag.PrintDefaults()
+	}
+	pflag.Parse()
+	if err := config.Load(&conf, pflag.CommandLine, config.Config.ValidateMigrate); err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	if conf.Database.Type != "postgres" {
+		log.Fatal("Only the postgres database has migrations, not ", conf.Database.Type)
+	}
+	if pflag.NArg() != 1 {
+		pflag.Usage()
+		os.Exit(2)
+	}
+
+	dbAPI := db.PrepareMigrationDB(conf.Database.Postgres)
+	defer dbAPI.Close()
+
+	switch pflag.Arg(0) {
+	case "up":
+		n, err := dbAPI.MigrateUp()
+		if err != nil {
+			log.Fatal("Error migrating up after ", n, " migrations: ", err)
+		}
+		version, err := dbAPI.SchemaVersion()
+		if err != nil {
+			log.Fatal("Error reading the schema version: ", err)
+		}
+		log.Infoln("Applied", n, "migrations, the schema is at version", version)
+	case "down":
+		if *steps <= 0 {
+			log.Fatal("--steps must be positive, got ", *steps)
+		}
+		n, err := dbAPI.MigrateDown(*steps)
+		if err != nil {
+			log.Fatal("Error migrating down after ", n, " migrations: ", err)
+		}
+		version, err := dbAPI.SchemaVersion()
+		if err != nil {
+			log.Fatal("Error reading the schema version: ", err)
+		}
+		log.Infoln("Reverted", n, "migrations, the schema is at version", version)
+	case "status":
+		status, err := dbAPI.MigrationStatus()
+		if err != nil {
+			log.Fatal("Error reading the applied migrations: ", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, s := range status {
+			applied := "pending"
+			if !s.AppliedAt.IsZero() {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		_ = w.Flush()
+		if _, err := dbAPI.SchemaVersion(); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		pflag.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,43 @@
+package broker
+
+import "time"
+
+// Conf holds the parameters needed to consume from a broker
+type Conf struct {
+	Type  string `yaml:"type" toml:"type"`
+	Host  string `yaml:"host" toml:"host"`
+	Topic string `yaml:"topic" toml:"topic"`
+	// Path lists, separated by commas, the plain or gzip compressed log files replayed by the file broker, - is stdin
+	Path string `yaml:"path" toml:"path"`
+	// Speed paces the replay by the logged times of the entries, Speed times faster, 0 replays as fast as possible
+	Speed float64 `yaml:"speed" toml:"speed"`
+	// Exchange is the durable direct exchange the rabbitmq queues are bound to, by their names, "" publishes to them directly
+	Exchange string `yaml:"exchange" toml:"exchange"`
+	// Prefetch is how many rabbitmq or nats messages are delivered and not acked at most, 0 is unlimited
+	Prefetch int `yaml:"prefetch" toml:"prefetch"`
+	// ConsumerTag identifies the rabbitmq consumer, by default it is the hostname and pid
+	ConsumerTag string `yaml:"consumer_tag" toml:"consumer_tag"`
+	// ReconnectBackoff is how long the rabbitmq consumer waits before connecting again, doubled up to
+	// ReconnectBackoffMax while it fails. The nats client waits ReconnectBackoff between its attempts
+	ReconnectBackoff    time.Duration `yaml:"reconnect_backoff" toml:"reconnect_backoff"`
+	ReconnectBackoffMax time.Duration `yaml:"reconnect_backoff_max" toml:"reconnect_backoff_max"`
+	// Brokers are the bootstrap servers of the kafka broker
+	Brokers []string `yaml:"brokers" toml:"brokers"`
+	// Group is the kafka consumer group, its members share the partitions of the topic and their committed offsets,
+	// or the nats durable consumer, its members share the messages of the subject
+	Group string `yaml:"group" toml:"group"`
+	// RebalanceTimeout is how long the kafka group waits for its members to rejoin when the partitions are rebalanced
+	RebalanceTimeout time.Duration `yaml:"rebalance_timeout" toml:"rebalance_timeout"`
+	// StartOffset is where a new kafka group or nats durable consumer starts consuming: earliest or latest
+	StartOffset string `yaml:"start_offset" toml:"start_offset"`
+	// Dir is where the filequeue broker keeps its queues, a directory per topic
+	Dir string `yaml:"dir" toml:"dir"`
+	// SyslogAddr is the UDP address the ingest broker receives syslog on, HttpAddr the address it serves POST /ingest
+	// on, either is disabled when empty
+	SyslogAddr string `yaml:"syslog_addr" toml:"syslog_addr"`
+	HttpAddr   string `yaml:"http_addr" toml:"http_addr"`
+	// Buffer is how many log entries the ingest broker buffers, those received while it is full are dropped
+	Buffer int `yaml:"buffer" toml:"buffer"`
+	// ReplayFrom is the RFC 3339 time a new nats durable consumer starts consuming from instead of StartOffset
+	ReplayFrom string `yaml:"replay_from" toml:"replay_from"`
+}
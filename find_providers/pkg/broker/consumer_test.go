@@ -0,0 +1,140 @@
+package broker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// expectMessage receives the next message of the consumer and checks its body, failing if none comes within timeout
+func expectMessage(t *testing.T, c Consumer, body string, timeout time.Duration) Message {
+	t.Helper()
+	select {
+	case msg := <-c.Messages():
+		if msg.Body != body {
+			t.Fatalf("received %q, expected %q", msg.Body, body)
+		}
+		return msg
+	case <-time.After(timeout):
+		t.Fatalf("received nothing in %v, expected %q", timeout, body)
+	}
+	return Message{}
+}
+
+// expectNoMessage checks that the consumer delivers nothing during wait
+func expectNoMessage(t *testing.T, c Consumer, wait time.Duration) {
+	t.Helper()
+	select {
+	case msg := <-c.Messages():
+		t.Fatalf("received %q, expected nothing", msg.Body)
+	case <-time.After(wait):
+	}
+}
+
+// ackAll acks the messages the consumer delivers until it delivers none during wait, and returns their bodies
+func ackAll(c Consumer, wait time.Duration) []string {
+	var bodies []string
+	for {
+		select {
+		case msg := <-c.Messages():
+			msg.Ack()
+			bodies = append(bodies, msg.Body)
+		case <-time.After(wait):
+			return bodies
+		}
+	}
+}
+
+// localBrokers are the brokers running without a broker service, with the configuration of a new topic
+var localBrokers = map[string]func(t *testing.T) Conf{
+	"memory": func(t *testing.T) Conf {
+		return Conf{Type: "memory", Topic: fmt.Sprintf("%v-%d", t.Name(), time.Now().UnixNano())}
+	},
+	"filequeue": func(t *testing.T) Conf {
+		return Conf{Type: "filequeue", Topic: "gateway-logs", Dir: t.TempDir()}
+	},
+}
+
+// publish publishes the bodies to the topic of conf
+func publish(t *testing.T, conf Conf, bodies ...string) {
+	t.Helper()
+	publisher := PrepareBatchPublisher(conf)
+	defer publisher.Close()
+	batch := make([][]byte, len(bodies))
+	for i, body := range bodies {
+		batch[i] = []byte(body)
+	}
+	if err := publisher.PublishBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalBrokersDeliverInOrderAndForgetAcked(t *testing.T) {
+	for name, testConf := range localBrokers {
+		t.Run(name, func(t *testing.T) {
+			conf := testConf(t)
+			publish(t, conf, "a", "b")
+			consumer := PrepareBroker(conf)
+			expectMessage(t, consumer, "a", time.Second).Ack()
+			expectMessage(t, consumer, "b", time.Second).Ack()
+			expectNoMessage(t, consumer, 500*time.Millisecond)
+			_ = consumer.Close()
+
+			consumer = PrepareBroker(conf)
+			defer consumer.Close()
+			expectNoMessage(t, consumer, 500*time.Millisecond)
+		})
+	}
+}
+
+func TestLocalBrokersRequeueNacks(t *testing.T) {
+	for name, testConf := range localBrokers {
+		t.Run(name, func(t *testing.T) {
+			conf := testConf(t)
+			publish(t, conf, "a")
+			consumer := PrepareBroker(conf)
+			defer consumer.Close()
+			expectMessage(t, consumer, "a", time.Second).Nack(true)
+			// dropped once nacked without requeue
+			expectMessage(t, consumer, "a", time.Second).Nack(false)
+			expectNoMessage(t, consumer, 500*time.Millisecond)
+			publish(t, conf, "b")
+			expectMessage(t, consumer, "b", time.Second).Ack()
+			expectNoMessage(t, consumer, 500*time.Millisecond)
+		})
+	}
+}
+
+func TestLocalBrokersRecoverMessagesOfStoppedConsumers(t *testing.T) {
+	for name, testConf := range localBrokers {
+		t.Run(name, func(t *testing.T) {
+			conf := testConf(t)
+			publish(t, conf, "a")
+			stopped := PrepareBroker(conf)
+			expectMessage(t, stopped, "a", time.Second)
+
+			// neither publishing nor another consumer takes the message of a running consumer, which may hold b too
+			publish(t, conf, "b")
+			other := PrepareBroker(conf)
+			received := ackAll(other, 500*time.Millisecond)
+			_ = other.Close()
+			for _, body := range received {
+				if body == "a" {
+					t.Fatal("received a, delivered to a running consumer")
+				}
+			}
+
+			// stopping without acking, as a crash would
+			_ = stopped.Close()
+			consumer := PrepareBroker(conf)
+			defer consumer.Close()
+			received = append(received, ackAll(consumer, 500*time.Millisecond)...)
+			sort.Strings(received)
+			if strings.Join(received, ",") != "a,b" {
+				t.Fatalf("received %v, expected a and b once", received)
+			}
+		})
+	}
+}
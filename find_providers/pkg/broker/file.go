@@ -0,0 +1,121 @@
+package broker
+
+import (
+	"bufio"
+	"compress/gzip"
+	"find_providers/pkg/parser"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxLineSize bounds the length of a replayed log entry
+const maxLineSize = 1024 * 1024
+
+// fileConsumer replays log files, delivering their entries in order
+type fileConsumer struct {
+	messages chan Message
+}
+
+// prepareFiles opens the comma separated log files of paths, - being stdin, and starts replaying them at speed
+func prepareFiles(paths string, speed float64) *fileConsumer {
+	var files []*os.File
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "-" {
+			files = append(files, os.Stdin)
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			panic(err)
+		}
+		files = append(files, f)
+	}
+	c := &fileConsumer{messages: make(chan Message)}
+	go consumeFiles(files, speed, c.messages)
+	return c
+}
+
+func (c *fileConsumer) Messages() <-chan Message {
+	return c.messages
+}
+
+// Close does nothing, the replay ends with the files
+func (c *fileConsumer) Close() error {
+	return nil
+}
+
+// consumeFiles replays the log entries of the files one after the other, then closes logCh
+// With a positive speed the entries are replayed at the pace of their logged times, speed times faster
+func consumeFiles(files []*os.File, speed float64, logCh chan Message) {
+	defer close(logCh)
+	p := pacer{speed: speed}
+	for _, f := range files {
+		n, err := consumeFile(f, &p, logCh)
+		if err != nil {
+			log.Error("Error replaying ", f.Name(), " after ", n, " log entries: ", err)
+		} else {
+			log.Infoln("Replayed", n, "log entries from", f.Name())
+		}
+		_ = f.Close()
+	}
+}
+
+// consumeFile replays the log entries of a plain or gzip compressed file and returns how many were replayed
+func consumeFile(f *os.File, p *pacer, logCh chan Message) (int, error) {
+	r := bufio.NewReader(f)
+	var in io.Reader = r
+	if magic, err := r.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	n := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		p.wait(line)
+		logCh <- Message{Body: line}
+		n++
+	}
+	return n, scanner.Err()
+}
+
+// pacer spaces log entries as their logged times are, speed times faster
+type pacer struct {
+	speed float64
+	// first is the logged time of the first entry and start when it was replayed
+	first time.Time
+	start time.Time
+}
+
+// wait waits until the entry is due, entries whose time cannot be parsed are due right away
+func (p *pacer) wait(line string) {
+	if p.speed <= 0 {
+		return
+	}
+	e, err := parser.ParseLogEntry(line)
+	if err != nil {
+		return
+	}
+	if p.start.IsZero() {
+		p.first, p.start = e.Time, time.Now()
+		return
+	}
+	due := p.start.Add(time.Duration(float64(e.Time.Sub(p.first)) / p.speed))
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+}
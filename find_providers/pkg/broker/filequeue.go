@@ -0,0 +1,413 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fileQueuePoll is how often an empty file queue is checked for new messages
+const fileQueuePoll = 200 * time.Millisecond
+
+// fileQueueRecoverInterval is how often a consumer puts back the messages of the consumers that stopped since
+const fileQueueRecoverInterval = 10 * time.Second
+
+// fileQueueSeq numbers the messages published by the process, to tell apart those published at the same time
+var fileQueueSeq uint64
+
+// fileQueue is a durable queue kept in a directory, a file per message named by the time it was published
+// Messages are written to tmp/ and renamed into ready/ once synced. A queue taking messages owns a directory in
+// inflight/, locked as long as the process lives, where it renames the messages it delivers so each one goes to a
+// single consumer, also across processes. Acking a message removes its file and nacking it with requeue renames it
+// back into ready/. The messages left in the directory of an owner that stopped, whose lock is free, are put back
+// in ready/ by the next queue taking messages. Queues only publishing never touch inflight/
+type fileQueue struct {
+	dir string
+
+	lock sync.Mutex
+	// owner is the directory of the queue in inflight/, set once it takes messages, and ownerLock its lock
+	owner     string
+	ownerLock *os.File
+}
+
+// openFileQueue opens the queue of the topic in dir, creating it if needed
+func openFileQueue(dir, topic string) (*fileQueue, error) {
+	q := &fileQueue{dir: filepath.Join(dir, topic)}
+	for _, sub := range []string{"tmp", "ready", "inflight"} {
+		if err := os.MkdirAll(filepath.Join(q.dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+// claim makes the queue an owner of messages in flight, locking its own directory in inflight/, and puts back in
+// ready/ the messages of the owners that stopped
+func (q *fileQueue) claim() (string, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.owner != "" {
+		return q.owner, nil
+	}
+	owner := fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+	lock, ok, err := lockOwner(q.path("inflight", owner+".lock"), os.O_CREATE)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("owner %v of file queue %v is already locked", owner, q.dir)
+	}
+	if err := os.Mkdir(q.path("inflight", owner), 0755); err != nil {
+		_ = lock.Close()
+		return "", err
+	}
+	q.owner, q.ownerLock = owner, lock
+	if err := q.recover(); err != nil {
+		log.Warning("Error putting back the messages of stopped consumers of file queue ", q.dir, ": ", err)
+	}
+	return owner, nil
+}
+
+// recover puts back in ready/ the messages in flight of the owners whose lock is free, as they stopped
+func (q *fileQueue) recover() error {
+	entries, err := os.ReadDir(q.path("inflight", ""))
+	if err != nil {
+		return err
+	}
+	recovered := 0
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() {
+			if filepath.Ext(name) != ".lock" {
+				// left directly in inflight/ by earlier versions
+				if err := os.Rename(q.path("inflight", name), q.path("ready", name)); err == nil {
+					recovered++
+				}
+			}
+			continue
+		}
+		if name == q.owner {
+			continue
+		}
+		n, err := q.recoverOwner(name)
+		if err != nil {
+			return err
+		}
+		recovered += n
+	}
+	if recovered > 0 {
+		log.Infoln("Put back", recovered, "messages not acked by stopped consumers of", q.dir)
+	}
+	return nil
+}
+
+// recoverOwner puts back the messages in flight of the owner if it stopped, and removes its directory
+func (q *fileQueue) recoverOwner(owner string) (int, error) {
+	lockPath := q.path("inflight", owner+".lock")
+	// owners create their lock before their directory, and recovering removes it last
+	lock, ok, err := lockOwner(lockPath, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		// recovered by someone else meanwhile
+		return 0, nil
+	}
+	if err != nil || !ok {
+		return 0, err
+	}
+	defer lock.Close()
+	dir := q.path("inflight", owner)
+	names, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		// recovered by someone else meanwhile, up to removing the lock
+		return 0, os.Remove(lockPath)
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range names {
+		if err := os.Rename(filepath.Join(dir, e.Name()), q.path("ready", e.Name())); err != nil {
+			return 0, err
+		}
+	}
+	if err := os.Remove(dir); err != nil {
+		return len(names), err
+	}
+	return len(names), os.Remove(lockPath)
+}
+
+// lockOwner opens, with the extra flags, and locks the lock file of an owner, returns false if its owner holds it
+// The lock is released when the file is closed, also when the process dies
+func lockOwner(path string, flags int) (*os.File, bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|flags, 0644)
+	if err != nil {
+		return nil, false, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		_ = f.Close()
+		return nil, false, nil
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, false, err
+	}
+	return f, true, nil
+}
+
+// prepareFileQueue opens the queue of the topic of conf, in Dir
+func prepareFileQueue(conf Conf) *fileQueue {
+	q, err := openFileQueue(conf.Dir, conf.Topic)
+	if err != nil {
+		panic(err)
+	}
+	return q
+}
+
+// path returns the path of the message name in the sub directory of the queue
+func (q *fileQueue) path(sub, name string) string {
+	return filepath.Join(q.dir, sub, name)
+}
+
+// inflight returns the path of the message name in flight, in the directory the queue owns
+func (q *fileQueue) inflight(name string) string {
+	return filepath.Join(q.dir, "inflight", q.owner, name)
+}
+
+// Publish writes a message to the queue
+func (q *fileQueue) Publish(body []byte) error {
+	return q.PublishBatch([][]byte{body})
+}
+
+// PublishBatch writes the messages to the queue, they are all on disk once it returns
+func (q *fileQueue) PublishBatch(bodies [][]byte) error {
+	for _, body := range bodies {
+		name := fmt.Sprintf("%020d-%d-%d", time.Now().UnixNano(), os.Getpid(), atomic.AddUint64(&fileQueueSeq, 1))
+		if err := writeSynced(q.path("tmp", name), body); err != nil {
+			return err
+		}
+		if err := os.Rename(q.path("tmp", name), q.path("ready", name)); err != nil {
+			return err
+		}
+	}
+	return syncDir(q.path("ready", ""))
+}
+
+// Pull calls f with the next message of the queue, which is removed if f succeeds and put back otherwise
+func (q *fileQueue) Pull(f func(body []byte) error) (bool, error) {
+	if _, err := q.claim(); err != nil {
+		return false, err
+	}
+	names, err := q.readyNames()
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		body, ok, err := q.take(name)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			continue
+		}
+		if err := f(body); err != nil {
+			if rerr := q.requeue(name); rerr != nil {
+				return true, rerr
+			}
+			return true, err
+		}
+		return true, q.remove(name)
+	}
+	return false, nil
+}
+
+// Len returns how many messages are ready in the queue
+func (q *fileQueue) Len() (int, error) {
+	names, err := q.readyNames()
+	return len(names), err
+}
+
+// Close releases the messages in flight of the queue, they are put back by the next queue taking messages
+func (q *fileQueue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.ownerLock == nil {
+		return nil
+	}
+	err := q.ownerLock.Close()
+	q.ownerLock = nil
+	return err
+}
+
+// readyNames lists the messages ready in the queue, oldest first
+func (q *fileQueue) readyNames() ([]string, error) {
+	entries, err := os.ReadDir(q.path("ready", ""))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names, nil
+}
+
+// take moves a ready message in flight and reads it, returns false if another consumer took it first
+func (q *fileQueue) take(name string) ([]byte, bool, error) {
+	if _, err := q.claim(); err != nil {
+		return nil, false, err
+	}
+	err := os.Rename(q.path("ready", name), q.inflight(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	body, err := os.ReadFile(q.inflight(name))
+	if err != nil {
+		return nil, false, err
+	}
+	return body, true, nil
+}
+
+// requeue moves a message in flight back to ready, where it keeps its place
+func (q *fileQueue) requeue(name string) error {
+	return os.Rename(q.inflight(name), q.path("ready", name))
+}
+
+// remove removes a message in flight
+func (q *fileQueue) remove(name string) error {
+	return os.Remove(q.inflight(name))
+}
+
+// writeSynced writes a file and syncs it to disk
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir syncs a directory, so the files renamed into it are on disk
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// fileQueueConsumer consumes a file queue
+type fileQueueConsumer struct {
+	queue    *fileQueue
+	messages chan Message
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// prepareFileQueueConsumer prepares a consumer of the file queue of the topic of conf
+func prepareFileQueueConsumer(conf Conf) *fileQueueConsumer {
+	c := &fileQueueConsumer{queue: prepareFileQueue(conf), messages: make(chan Message), closed: make(chan struct{})}
+	// puts back the messages of the consumers that stopped, also if none is published
+	if _, err := c.queue.claim(); err != nil {
+		panic(err)
+	}
+	go c.consume()
+	return c
+}
+
+func (c *fileQueueConsumer) Messages() <-chan Message {
+	return c.messages
+}
+
+// Close stops consuming, the messages not acked are put back by the next consumer of the queue
+func (c *fileQueueConsumer) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.closed)
+		err = c.queue.Close()
+	})
+	return err
+}
+
+// consume delivers the messages of the queue, oldest first, until the consumer is closed
+func (c *fileQueueConsumer) consume() {
+	lastRecover := time.Now()
+	for {
+		if time.Since(lastRecover) >= fileQueueRecoverInterval {
+			lastRecover = time.Now()
+			if err := c.queue.recover(); err != nil {
+				log.Warning("Error putting back the messages of stopped consumers of file queue ", c.queue.dir, ": ", err)
+			}
+		}
+		names, err := c.queue.readyNames()
+		if err != nil {
+			log.Warning("Error listing file queue ", c.queue.dir, ": ", err)
+		}
+		delivered := 0
+		for _, name := range names {
+			body, ok, err := c.queue.take(name)
+			if err != nil {
+				log.Warning("Error taking message ", name, " from file queue ", c.queue.dir, ": ", err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			select {
+			case c.messages <- c.message(name, body):
+				delivered++
+			case <-c.closed:
+				_ = c.queue.requeue(name)
+				return
+			}
+		}
+		if delivered > 0 {
+			continue
+		}
+		select {
+		case <-time.After(fileQueuePoll):
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// message wraps a message in flight, acking removes it and nacking puts it back or removes it
+func (c *fileQueueConsumer) message(name string, body []byte) Message {
+	return Message{
+		Body: string(body),
+		ack: func() {
+			if err := c.queue.remove(name); err != nil {
+				log.Warning("Error acking file queue message:", err)
+			}
+		},
+		nack: func(requeue bool) {
+			var err error
+			if requeue {
+				err = c.queue.requeue(name)
+			} else {
+				err = c.queue.remove(name)
+			}
+			if err != nil {
+				log.Warning("Error nacking file queue message:", err)
+			}
+		},
+	}
+}
@@ -0,0 +1,205 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxIngestBody bounds the size of a batch posted to /ingest
+const maxIngestBody = 16 * 1024 * 1024
+
+// ingestDropLogInterval is how often the ingest server logs that it is dropping log entries at most
+const ingestDropLogInterval = time.Minute
+
+// IngestStats are the counters of the ingest server, per source
+type IngestStats struct {
+	SyslogReceived int64 `json:"syslog_received"`
+	SyslogDropped  int64 `json:"syslog_dropped"`
+	HttpReceived   int64 `json:"http_received"`
+	HttpDropped    int64 `json:"http_dropped"`
+	Buffered       int   `json:"buffered"`
+}
+
+// ingestConsumer receives log entries sent by nginx, as syslog over UDP or batches posted over HTTP
+// Entries wait in a bounded buffer, those received while it is full are dropped and counted. Nothing is acked, an
+// entry is lost if the controller stops before processing it
+type ingestConsumer struct {
+	// accessed atomically, kept first for 64-bit alignment
+	syslogReceived int64
+	syslogDropped  int64
+	httpReceived   int64
+	httpDropped    int64
+	lastDropLogNs  int64
+
+	messages chan Message
+	udp      net.PacketConn
+	server   *http.Server
+}
+
+// prepareIngest starts the listeners of conf, on SyslogAddr for syslog and HttpAddr for POST /ingest
+func prepareIngest(conf Conf) *ingestConsumer {
+	c := &ingestConsumer{messages: make(chan Message, conf.Buffer)}
+	if conf.SyslogAddr != "" {
+		udp, err := net.ListenPacket("udp", conf.SyslogAddr)
+		if err != nil {
+			panic(err)
+		}
+		c.udp = udp
+		log.Infoln("Receiving syslog log entries on", udp.LocalAddr())
+		go c.receiveSyslog()
+	}
+	if conf.HttpAddr != "" {
+		listener, err := net.Listen("tcp", conf.HttpAddr)
+		if err != nil {
+			panic(err)
+		}
+		router := mux.NewRouter().StrictSlash(true)
+		router.HandleFunc("/ingest", c.ingest).Methods("POST")
+		router.HandleFunc("/stats", c.stats).Methods("GET")
+		c.server = &http.Server{Handler: router}
+		log.Info("Receiving log entries on http://", listener.Addr(), "/ingest")
+		go func() {
+			if err := c.server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+				log.Error("Ingest server stopped: ", err)
+			}
+		}()
+	}
+	return c
+}
+
+func (c *ingestConsumer) Messages() <-chan Message {
+	return c.messages
+}
+
+// Close stops receiving log entries, those still buffered are lost
+func (c *ingestConsumer) Close() error {
+	var err error
+	if c.udp != nil {
+		err = c.udp.Close()
+	}
+	if c.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if serr := c.server.Shutdown(ctx); serr != nil {
+			err = serr
+		}
+	}
+	st := c.Stats()
+	log.Infoln("Ingest server stopped, syslog received:", st.SyslogReceived, "dropped:", st.SyslogDropped,
+		"http received:", st.HttpReceived, "dropped:", st.HttpDropped)
+	return err
+}
+
+// Stats returns the current counters of the ingest server
+func (c *ingestConsumer) Stats() IngestStats {
+	return IngestStats{
+		SyslogReceived: atomic.LoadInt64(&c.syslogReceived),
+		SyslogDropped:  atomic.LoadInt64(&c.syslogDropped),
+		HttpReceived:   atomic.LoadInt64(&c.httpReceived),
+		HttpDropped:    atomic.LoadInt64(&c.httpDropped),
+		Buffered:       len(c.messages),
+	}
+}
+
+// receiveSyslog receives a log entry per datagram until the listener is closed
+func (c *ingestConsumer) receiveSyslog() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := c.udp.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Warning("Error receiving syslog datagram:", err)
+			continue
+		}
+		entry := strings.TrimRight(syslogMessage(string(buf[:n])), "\r\n")
+		if entry == "" {
+			continue
+		}
+		atomic.AddInt64(&c.syslogReceived, 1)
+		c.buffer(entry, &c.syslogDropped)
+	}
+}
+
+// syslogMessage returns the message of an RFC 3164 syslog datagram, as nginx sends them:
+// <PRI>TIMESTAMP HOSTNAME TAG: MSG. Datagrams without a PRI are taken as the message itself
+func syslogMessage(datagram string) string {
+	if !strings.HasPrefix(datagram, "<") {
+		return datagram
+	}
+	end := strings.IndexByte(datagram, '>')
+	if end < 0 {
+		return datagram
+	}
+	header := datagram[end+1:]
+	// the first ": " ends the tag, the timestamp and hostname have none
+	if i := strings.Index(header, ": "); i >= 0 {
+		return header[i+2:]
+	}
+	return header
+}
+
+// ingest buffers the log entries posted, one per line, and reports how many were accepted and dropped
+func (c *ingestConsumer) ingest(w http.ResponseWriter, r *http.Request) {
+	scanner := bufio.NewScanner(http.MaxBytesReader(w, r.Body, maxIngestBody))
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	var accepted, dropped int64
+	for scanner.Scan() {
+		entry := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		atomic.AddInt64(&c.httpReceived, 1)
+		if c.buffer(entry, &c.httpDropped) {
+			accepted++
+		} else {
+			dropped++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int64{"accepted": accepted, "dropped": dropped})
+}
+
+// stats reports the counters of the ingest server
+func (c *ingestConsumer) stats(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(c.Stats())
+}
+
+// buffer queues a log entry, returns false if the buffer is full and the entry dropped, counted in dropped
+func (c *ingestConsumer) buffer(entry string, dropped *int64) bool {
+	select {
+	case c.messages <- Message{Body: entry}:
+		return true
+	default:
+		atomic.AddInt64(dropped, 1)
+		c.logDrops()
+		return false
+	}
+}
+
+// logDrops warns that log entries are dropped, at most once per ingestDropLogInterval
+func (c *ingestConsumer) logDrops() {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&c.lastDropLogNs)
+	if now-last < int64(ingestDropLogInterval) || !atomic.CompareAndSwapInt64(&c.lastDropLogNs, last, now) {
+		return
+	}
+	st := c.Stats()
+	log.Warning("Ingest buffer full, dropping log entries, syslog dropped: ", st.SyslogDropped, " http dropped: ", st.HttpDropped)
+}
@@ -0,0 +1,145 @@
+package broker
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gatewayEntry is a log entry as nginx writes it
+const gatewayEntry = `199.83.232.50 - - [2022-03-21T00:00:58+00:00] "GET /ipfs/QmPvt7yHLGpVhd4jVFX6reEZZ34fQRepQ1a1QTsZQBH1hJ HTTP/1.1" 200 50470 120 12.823 12.820 12.820 MISS "-" "-" *.i.ipfs.io ipfs.io https`
+
+func TestSyslogMessage(t *testing.T) {
+	for _, c := range []struct {
+		name, datagram, message string
+	}{
+		{name: "rfc 3164", datagram: "<190>Mar 21 00:00:58 gateway nginx: " + gatewayEntry, message: gatewayEntry},
+		{name: "day below 10", datagram: "<190>Mar  1 00:00:58 gateway nginx: " + gatewayEntry, message: gatewayEntry},
+		{name: "no hostname", datagram: "<190>Mar 21 00:00:58 nginx: " + gatewayEntry, message: gatewayEntry},
+		// the first ": " ends the tag, those of the message are kept
+		{name: "colons in the message", datagram: "<190>Mar 21 00:00:58 gateway nginx: a: b: c", message: "a: b: c"},
+		{name: "no tag", datagram: "<190>" + gatewayEntry, message: gatewayEntry},
+		{name: "no pri", datagram: gatewayEntry, message: gatewayEntry},
+		{name: "unterminated pri", datagram: "<190 " + gatewayEntry, message: "<190 " + gatewayEntry},
+		{name: "empty message", datagram: "<190>Mar 21 00:00:58 gateway nginx: ", message: ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if message := syslogMessage(c.datagram); message != c.message {
+				t.Fatalf("got %q, expected %q", message, c.message)
+			}
+		})
+	}
+}
+
+// postIngest posts body to the ingest handler of c and returns the status and the counts answered
+func postIngest(t *testing.T, c *ingestConsumer, body string) (int, map[string]int64) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(c.ingest))
+	defer server.Close()
+	resp, err := http.Post(server.URL, "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var counts map[string]int64
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&counts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, counts
+}
+
+func TestIngest(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		buffer int
+		body   string
+		// entries are the entries buffered
+		entries           []string
+		accepted, dropped int64
+	}{
+		{name: "one per line", buffer: 10, body: "a\nb\nc", entries: []string{"a", "b", "c"}, accepted: 3},
+		{name: "blank lines skipped", buffer: 10, body: "a\n\n  \nb\n", entries: []string{"a", "b"}, accepted: 2},
+		{name: "crlf", buffer: 10, body: "a\r\nb\r\n", entries: []string{"a", "b"}, accepted: 2},
+		{name: "dropped when full", buffer: 2, body: "a\nb\nc\nd", entries: []string{"a", "b"}, accepted: 2, dropped: 2},
+		{name: "empty", buffer: 10, body: ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			consumer := &ingestConsumer{messages: make(chan Message, c.buffer)}
+			status, counts := postIngest(t, consumer, c.body)
+			if status != http.StatusOK {
+				t.Fatalf("got status %v", status)
+			}
+			if counts["accepted"] != c.accepted || counts["dropped"] != c.dropped {
+				t.Fatalf("got %v, expected %v accepted and %v dropped", counts, c.accepted, c.dropped)
+			}
+			st := consumer.Stats()
+			if st.HttpReceived != c.accepted+c.dropped || st.HttpDropped != c.dropped || st.Buffered != len(c.entries) {
+				t.Fatalf("got %+v", st)
+			}
+			for _, entry := range c.entries {
+				expectMessage(t, consumer, entry, time.Second)
+			}
+		})
+	}
+}
+
+func TestIngestRejectsOversizedBodies(t *testing.T) {
+	line := strings.Repeat("a", 1023) + "\n"
+	for _, c := range []struct {
+		name, body string
+	}{
+		{name: "body", body: strings.Repeat(line, maxIngestBody/len(line)+1)},
+		{name: "line", body: strings.Repeat("a", maxLineSize+1)},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			consumer := &ingestConsumer{messages: make(chan Message, 1)}
+			if status, _ := postIngest(t, consumer, c.body); status != http.StatusBadRequest {
+				t.Fatalf("got status %v, expected %v", status, http.StatusBadRequest)
+			}
+		})
+	}
+
+	// a body of exactly maxIngestBody is accepted
+	consumer := &ingestConsumer{messages: make(chan Message, 1)}
+	body := strings.Repeat(line, maxIngestBody/len(line))
+	if status, counts := postIngest(t, consumer, body); status != http.StatusOK || counts["accepted"]+counts["dropped"] != int64(maxIngestBody/len(line)) {
+		t.Fatalf("got status %v and %v", status, counts)
+	}
+}
+
+func TestIngestSyslog(t *testing.T) {
+	consumer := prepareIngest(Conf{SyslogAddr: "127.0.0.1:0", Buffer: 2})
+	defer consumer.Close()
+	conn, err := net.Dial("udp", consumer.udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, datagram := range []string{
+		"<190>Mar 21 00:00:58 gateway nginx: a\n",
+		// an empty message is not counted
+		"<190>Mar 21 00:00:58 gateway nginx: ",
+		"b",
+		"<190>Mar 21 00:00:58 gateway nginx: c",
+	} {
+		if _, err := conn.Write([]byte(datagram)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for consumer.Stats().SyslogReceived < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := consumer.Stats(); st.SyslogReceived != 3 || st.SyslogDropped != 1 || st.Buffered != 2 {
+		t.Fatalf("got %+v, expected 3 entries received, 1 dropped", st)
+	}
+	expectMessage(t, consumer, "a", time.Second)
+	expectMessage(t, consumer, "b", time.Second)
+}
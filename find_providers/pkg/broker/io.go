@@ -1,22 +1,160 @@
 package broker
 
-import log "github.com/sirupsen/logrus"
+import (
+	"fmt"
 
-// PrepareBroker prepares a broker for reading
-func PrepareBroker(brokerToUse, host, topic string) chan string {
+	log "github.com/sirupsen/logrus"
+)
 
-	logch := make(chan string)
-	switch brokerToUse {
+// Publisher publishes messages to a broker topic
+type Publisher interface {
+	Publish(body []byte) error
+	Close() error
+}
+
+// BatchPublisher publishes batches of messages that the broker confirms
+type BatchPublisher interface {
+	// PublishBatch publishes the messages in order and returns once the broker confirmed it has all of them
+	// On error some of them may have been published, publishing the batch again duplicates them
+	PublishBatch(bodies [][]byte) error
+	Close() error
+}
+
+// Message is a log entry consumed from a broker
+// It must be acked once processed, or nacked if it cannot be
+type Message struct {
+	Body string
+	ack  func()
+	nack func(requeue bool)
+}
+
+// Ack tells the broker the message was processed, so it is not delivered again
+func (m Message) Ack() {
+	if m.ack != nil {
+		m.ack()
+	}
+}
+
+// Nack tells the broker the message could not be processed, with requeue it is delivered again, otherwise dropped
+// The kafka broker delivers nacked messages again in the same process, after a backoff, and commits the offsets of their partition
+// past them only once they are acked. The file and ingest brokers cannot deliver a message again, they ignore acks
+// and nacks
+func (m Message) Nack(requeue bool) {
+	if m.nack != nil {
+		m.nack(requeue)
+	}
+}
+
+// Consumer consumes the messages of a broker topic
+type Consumer interface {
+	// Messages returns the consumed messages
+	// The channel of the file broker is closed once the files are replayed, the others are never closed
+	Messages() <-chan Message
+	// Close stops consuming, the messages not acked yet are delivered again to the next consumer
+	Close() error
+}
+
+// State is the state of the connection to a broker
+type State string
+
+// states of the connection to a broker, once failed it is not connected again
+const (
+	StateConnected    State = "connected"
+	StateDisconnected State = "disconnected"
+	StateFailed       State = "failed"
+)
+
+// StateChange tells that the connection to a broker changed, Err is why it was lost
+type StateChange struct {
+	State State
+	Err   error
+}
+
+// Reconnector is a Consumer that connects again to its broker when the connection is lost
+type Reconnector interface {
+	// States returns the changes of the connection, those happening while the caller is behind are dropped, except
+	// StateFailed which is the last one
+	States() <-chan StateChange
+}
+
+// Queue is a broker topic that messages are published to and pulled from one at a time
+type Queue interface {
+	Publisher
+	// Pull calls f with the next message, which is removed from the queue only if f succeeds
+	// Returns false if the queue is empty
+	Pull(f func(body []byte) error) (bool, error)
+	// Len returns how many messages are waiting in the queue
+	Len() (int, error)
+}
+
+// PrepareBroker prepares a broker for consuming from the topic of conf
+func PrepareBroker(conf Conf) Consumer {
+	switch conf.Type {
 	case "kafka":
 		log.Debug("Preparing kafka broker..")
-		//consumer := prepareKafka()
-		//consumeKafkaLog(consumer, logch)
+		return prepareKafka(conf)
 	case "rabbitmq":
 		log.Debug("Preparing rabbitmq broker..")
-		msgs := prepareRabbitMq(host, topic)
-		go consumeRabbitMq(msgs, logch)
+		return prepareRabbitMq(conf)
+	case "nats":
+		log.Debug("Preparing nats broker..")
+		return prepareNats(conf)
+	case "ingest":
+		log.Debug("Preparing ingest server..")
+		return prepareIngest(conf)
+	case "memory":
+		log.Debug("Preparing memory broker..")
+		return prepareMemory(conf)
+	case "filequeue":
+		log.Debug("Preparing file queue..")
+		return prepareFileQueueConsumer(conf)
+	case "file":
+		log.Debug("Preparing file replay..")
+		return prepareFiles(conf.Path, conf.Speed)
+	default:
+		panic(fmt.Sprintf("consuming from %v is not supported", conf.Type))
+	}
+}
 
+// PreparePublisher prepares a broker for publishing to the topic of conf
+func PreparePublisher(conf Conf) Publisher {
+	return PrepareQueue(conf)
+}
+
+// PrepareBatchPublisher prepares a broker for publishing confirmed batches to the topic of conf
+func PrepareBatchPublisher(conf Conf) BatchPublisher {
+	switch conf.Type {
+	case "rabbitmq":
+		log.Debug("Preparing rabbitmq publisher..")
+		return prepareRabbitMqPublisher(conf)
+	case "kafka":
+		log.Debug("Preparing kafka publisher..")
+		return prepareKafkaPublisher(conf)
+	case "nats":
+		log.Debug("Preparing nats publisher..")
+		return prepareNatsPublisher(conf)
+	case "memory":
+		return Memory(conf.Topic)
+	case "filequeue":
+		log.Debug("Preparing file queue..")
+		return prepareFileQueue(conf)
+	default:
+		panic(fmt.Sprintf("publishing to %v is not supported", conf.Type))
 	}
+}
 
-	return logch
+// PrepareQueue prepares a broker for publishing to and pulling from the topic of conf
+func PrepareQueue(conf Conf) Queue {
+	switch conf.Type {
+	case "rabbitmq":
+		log.Debug("Preparing rabbitmq queue..")
+		return prepareRabbitMqQueue(conf)
+	case "memory":
+		return Memory(conf.Topic)
+	case "filequeue":
+		log.Debug("Preparing file queue..")
+		return prepareFileQueue(conf)
+	default:
+		panic(fmt.Sprintf("publishing to %v is not supported", conf.Type))
+	}
 }
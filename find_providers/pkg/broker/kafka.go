@@ -1,39 +1,246 @@
 package broker
 
-// This is left commented because we were unable to containerize the Kafka client library
-
-//func prepareKafka() *kafka.Consumer {
-//	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
-//		"bootstrap.servers":    bootstrap_servers,
-//		"group.id":             group_id,
-//		"max.poll.interval.ms": max_poll_interval_ms,
-//		"default.topic.config": kafka.ConfigMap{"auto.offset.reset": "smallest"}})
-//
-//	if err != nil {
-//		panic(err)
-//	}
-//
-//	err = consumer.Subscribe("logs", nil)
-//	if err != nil {
-//		panic(err)
-//
-//	}
-//
-//	return consumer
-//}
-
-//func consumeKafkaLog(consumer *kafka.Consumer, logCh chan string) {
-//	run := true
-//	for run == true {
-//		ev := consumer.Poll(10000)
-//		switch e := ev.(type) {
-//		case *kafka.Message:
-//			logCh <- string(e.Value)
-//		case kafka.Error:
-//			_, _ = fmt.Fprintf(os.Stderr, "%% Error: %v\n", e)
-//			run = false
-//		default:
-//			//fmt.Printf("Ignored %v\n", e)
-//		}
-//	}
-//}
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// kafkaCommitInterval is how often the offsets of the processed messages are committed
+const kafkaCommitInterval = time.Second
+
+// kafkaRequeueBackoff is how long a message nacked with requeue waits before it is delivered again, doubled every
+// time the same message is requeued up to kafkaRequeueBackoffMax
+const (
+	kafkaRequeueBackoff    = 100 * time.Millisecond
+	kafkaRequeueBackoffMax = 30 * time.Second
+)
+
+// kafkaConsumer consumes a topic as a member of a kafka consumer group
+// Messages are processed concurrently and finish out of order, so the offset of a partition is committed only up
+// to the messages processed along with every message fetched before them
+type kafkaConsumer struct {
+	reader   *kafka.Reader
+	topic    string
+	messages chan Message
+	closed   chan struct{}
+	once     sync.Once
+
+	lock       sync.Mutex
+	partitions map[int]*partitionOffsets
+	// commitLock keeps the commits in order, a later offset is not overwritten by an earlier one
+	commitLock sync.Mutex
+}
+
+// partitionOffsets tracks the messages fetched from a partition that are not committed yet
+type partitionOffsets struct {
+	// fetched are the offsets in the order they were fetched, acked those of the processed messages
+	fetched []int64
+	acked   map[int64]bool
+}
+
+// prepareKafka prepares a consumer joining the group of conf
+func prepareKafka(conf Conf) *kafkaConsumer {
+	startOffset := kafka.FirstOffset
+	if conf.StartOffset == "latest" {
+		startOffset = kafka.LastOffset
+	}
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:          conf.Brokers,
+		GroupID:          conf.Group,
+		Topic:            conf.Topic,
+		StartOffset:      startOffset,
+		RebalanceTimeout: conf.RebalanceTimeout,
+		ErrorLogger: kafka.LoggerFunc(func(msg string, args ...interface{}) {
+			log.Warningf("Kafka: "+msg, args...)
+		}),
+	})
+	c := &kafkaConsumer{
+		reader:     reader,
+		topic:      conf.Topic,
+		messages:   make(chan Message),
+		closed:     make(chan struct{}),
+		partitions: make(map[int]*partitionOffsets),
+	}
+	go c.consume()
+	go c.commitProcessed()
+	return c
+}
+
+func (c *kafkaConsumer) Messages() <-chan Message {
+	return c.messages
+}
+
+// Close commits the offsets of the processed messages and leaves the group
+// Closing it again does nothing
+func (c *kafkaConsumer) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.closed)
+		c.commit()
+		err = c.reader.Close()
+	})
+	return err
+}
+
+// consume fetches messages from the partitions assigned to the consumer
+func (c *kafkaConsumer) consume() {
+	for {
+		m, err := c.reader.FetchMessage(context.Background())
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			log.Warning("Error fetching from kafka:", err)
+			time.Sleep(kafkaCommitInterval)
+			continue
+		}
+		c.deliver(c.message(m))
+	}
+}
+
+// message wraps a fetched message, acking it marks its offset processed and nacking it either delivers it again,
+// after a backoff growing with every requeue, or marks it processed too, as it is dropped
+func (c *kafkaConsumer) message(m kafka.Message) Message {
+	p := c.track(m.Partition, m.Offset)
+	msg := Message{Body: string(m.Value)}
+	backoff := kafkaRequeueBackoff
+	msg.ack = func() { c.ack(p, m.Offset) }
+	msg.nack = func(requeue bool) {
+		if !requeue {
+			c.ack(p, m.Offset)
+			return
+		}
+		wait := backoff
+		if backoff *= 2; backoff > kafkaRequeueBackoffMax {
+			backoff = kafkaRequeueBackoffMax
+		}
+		// not from the goroutine processing it, which would wait for itself
+		go func() {
+			select {
+			case <-time.After(wait):
+				c.deliver(msg)
+			case <-c.closed:
+			}
+		}()
+	}
+	return msg
+}
+
+// deliver hands a message over, unless the consumer is closed
+func (c *kafkaConsumer) deliver(msg Message) {
+	select {
+	case c.messages <- msg:
+	case <-c.closed:
+	}
+}
+
+// track records a message fetched from the partition and returns the offsets it is tracked in
+// Fetching an offset again means the partition was reassigned and consumed again from its committed offset,
+// it is then tracked anew, the messages fetched before are processed but no longer committed
+func (c *kafkaConsumer) track(partition int, offset int64) *partitionOffsets {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	p, ok := c.partitions[partition]
+	if !ok || (len(p.fetched) > 0 && offset <= p.fetched[len(p.fetched)-1]) {
+		p = &partitionOffsets{acked: make(map[int64]bool)}
+		c.partitions[partition] = p
+	}
+	p.fetched = append(p.fetched, offset)
+	return p
+}
+
+// ack marks the message at the offset of the partition as processed
+func (c *kafkaConsumer) ack(p *partitionOffsets, offset int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	p.acked[offset] = true
+}
+
+// processed pops the offsets of the messages processed along with every message fetched before them
+// Returns the last of them, or false if the first message fetched is still being processed
+func (p *partitionOffsets) processed() (int64, bool) {
+	n := 0
+	for n < len(p.fetched) && p.acked[p.fetched[n]] {
+		delete(p.acked, p.fetched[n])
+		n++
+	}
+	if n == 0 {
+		return 0, false
+	}
+	last := p.fetched[n-1]
+	p.fetched = p.fetched[n:]
+	return last, true
+}
+
+// commitProcessed periodically commits the offsets of the processed messages, until the consumer is closed
+func (c *kafkaConsumer) commitProcessed() {
+	ticker := time.NewTicker(kafkaCommitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.commit()
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// commit commits the offsets of the messages processed since the last commit
+func (c *kafkaConsumer) commit() {
+	c.commitLock.Lock()
+	defer c.commitLock.Unlock()
+	var commits []kafka.Message
+	c.lock.Lock()
+	for partition, p := range c.partitions {
+		if offset, ok := p.processed(); ok {
+			commits = append(commits, kafka.Message{Topic: c.topic, Partition: partition, Offset: offset})
+		}
+	}
+	c.lock.Unlock()
+	if len(commits) == 0 {
+		return
+	}
+	// a failed commit is covered by the next one of the partition, or the messages are consumed again
+	if err := c.reader.CommitMessages(context.Background(), commits...); err != nil {
+		log.Warning("Error committing kafka offsets:", err)
+	}
+}
+
+// kafkaPublisher publishes batches to a kafka topic, acknowledged by all the in-sync replicas
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+// prepareKafkaPublisher prepares a writer to the topic of conf
+func prepareKafkaPublisher(conf Conf) *kafkaPublisher {
+	return &kafkaPublisher{writer: &kafka.Writer{
+		Addr:         kafka.TCP(conf.Brokers...),
+		Topic:        conf.Topic,
+		Balancer:     &kafka.LeastBytes{},
+		RequiredAcks: kafka.RequireAll,
+		ErrorLogger: kafka.LoggerFunc(func(msg string, args ...interface{}) {
+			log.Warningf("Kafka: "+msg, args...)
+		}),
+	}}
+}
+
+// PublishBatch writes the messages and waits for the brokers to acknowledge them
+func (p *kafkaPublisher) PublishBatch(bodies [][]byte) error {
+	msgs := make([]kafka.Message, len(bodies))
+	for i, body := range bodies {
+		msgs[i] = kafka.Message{Value: body}
+	}
+	return p.writer.WriteMessages(context.Background(), msgs...)
+}
+
+// Close flushes and closes the writer
+func (p *kafkaPublisher) Close() error {
+	return p.writer.Close()
+}
@@ -0,0 +1,97 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaBrokersEnv holds the comma separated addresses of the kafka brokers the tests run against
+const kafkaBrokersEnv = "KAFKA_BROKERS"
+
+// kafkaTestConf returns the configuration of a new single partition topic and consumer group, skipping the test if
+// no broker is given
+func kafkaTestConf(t *testing.T) Conf {
+	brokers := os.Getenv(kafkaBrokersEnv)
+	if brokers == "" {
+		t.Skip(kafkaBrokersEnv, "is not set, skipping the kafka integration test")
+	}
+	name := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	conf := Conf{
+		Topic:            name,
+		Brokers:          strings.Split(brokers, ","),
+		Group:            name,
+		RebalanceTimeout: 10 * time.Second,
+		StartOffset:      "earliest",
+	}
+	client := &kafka.Client{Addr: kafka.TCP(conf.Brokers...)}
+	res, err := client.CreateTopics(context.Background(), &kafka.CreateTopicsRequest{
+		Topics: []kafka.TopicConfig{{Topic: name, NumPartitions: 1, ReplicationFactor: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := res.Errors[name]; err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+// committedOffset returns the offset committed by the group of conf on its partition
+func committedOffset(t *testing.T, conf Conf) int64 {
+	client := &kafka.Client{Addr: kafka.TCP(conf.Brokers...)}
+	res, err := client.OffsetFetch(context.Background(), &kafka.OffsetFetchRequest{
+		GroupID: conf.Group,
+		Topics:  map[string][]int{conf.Topic: {0}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Error != nil {
+		t.Fatal(res.Error)
+	}
+	return res.Topics[conf.Topic][0].CommittedOffset
+}
+
+func TestKafkaCommitsAckedOffsetsAndRedeliversNacks(t *testing.T) {
+	conf := kafkaTestConf(t)
+	publisher := prepareKafkaPublisher(conf)
+	if err := publisher.PublishBatch([][]byte{[]byte("a"), []byte("b"), []byte("c")}); err != nil {
+		t.Fatal(err)
+	}
+	_ = publisher.Close()
+
+	consumer := prepareKafka(conf)
+	a := expectMessage(t, consumer, "a", 30*time.Second)
+	b := expectMessage(t, consumer, "b", 5*time.Second)
+	expectMessage(t, consumer, "c", 5*time.Second)
+	a.Ack()
+	b.Nack(true)
+	// delivered again, and left unacked
+	expectMessage(t, consumer, "b", 5*time.Second)
+	time.Sleep(3 * kafkaCommitInterval)
+	if err := consumer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := consumer.Close(); err != nil {
+		t.Fatal("closing again:", err)
+	}
+	if offset := committedOffset(t, conf); offset != 1 {
+		t.Fatalf("committed offset %d, expected 1 as only a was acked", offset)
+	}
+
+	// the group starts again from the first message not acked
+	consumer = prepareKafka(conf)
+	defer consumer.Close()
+	expectMessage(t, consumer, "b", 30*time.Second).Ack()
+	expectMessage(t, consumer, "c", 5*time.Second).Ack()
+	time.Sleep(3 * kafkaCommitInterval)
+	if offset := committedOffset(t, conf); offset != 3 {
+		t.Fatalf("committed offset %d, expected 3 once every message was acked", offset)
+	}
+}
@@ -0,0 +1,213 @@
+package broker
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+)
+
+// memoryTopics are the topics of the memory broker, shared by everything in the process
+var memoryTopics = struct {
+	sync.Mutex
+	topics map[string]*MemoryTopic
+}{topics: map[string]*MemoryTopic{}}
+
+// MemoryTopic is a topic of the memory broker, its messages are lost when the process stops
+// A message is delivered to one of the consumers of the topic, and put back first if it is nacked with requeue
+type MemoryTopic struct {
+	lock  sync.Mutex
+	ready *list.List
+	// signalled when messages are published or requeued
+	published chan struct{}
+}
+
+// Memory returns the topic of the memory broker with that name, creating it if needed
+// Tests and tools running the pipeline in-process publish to it to feed the consumers of the topic
+func Memory(name string) *MemoryTopic {
+	memoryTopics.Lock()
+	defer memoryTopics.Unlock()
+	t, ok := memoryTopics.topics[name]
+	if !ok {
+		t = &MemoryTopic{ready: list.New(), published: make(chan struct{}, 1)}
+		memoryTopics.topics[name] = t
+	}
+	return t
+}
+
+// Publish appends a message to the topic
+func (t *MemoryTopic) Publish(body []byte) error {
+	t.lock.Lock()
+	t.ready.PushBack(string(body))
+	t.lock.Unlock()
+	t.signal()
+	return nil
+}
+
+// PublishBatch appends the messages to the topic
+func (t *MemoryTopic) PublishBatch(bodies [][]byte) error {
+	t.lock.Lock()
+	for _, body := range bodies {
+		t.ready.PushBack(string(body))
+	}
+	t.lock.Unlock()
+	t.signal()
+	return nil
+}
+
+// Pull calls f with the next message of the topic, which is put back first if f fails
+func (t *MemoryTopic) Pull(f func(body []byte) error) (bool, error) {
+	body, ok := t.take()
+	if !ok {
+		return false, nil
+	}
+	if err := f([]byte(body)); err != nil {
+		t.requeue(body)
+		return true, err
+	}
+	return true, nil
+}
+
+// Len returns how many messages are waiting in the topic
+func (t *MemoryTopic) Len() (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.ready.Len(), nil
+}
+
+// Close does nothing, the topic lives as long as the process
+func (t *MemoryTopic) Close() error {
+	return nil
+}
+
+// take removes the first message of the topic
+func (t *MemoryTopic) take() (string, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	front := t.ready.Front()
+	if front == nil {
+		return "", false
+	}
+	body := t.ready.Remove(front).(string)
+	if t.ready.Len() > 0 {
+		// another consumer may be waiting
+		t.signal()
+	}
+	return body, true
+}
+
+// requeue puts a message back first in the topic
+func (t *MemoryTopic) requeue(body string) {
+	t.lock.Lock()
+	t.ready.PushFront(body)
+	t.lock.Unlock()
+	t.signal()
+}
+
+// signal wakes up a consumer waiting for messages
+func (t *MemoryTopic) signal() {
+	select {
+	case t.published <- struct{}{}:
+	default:
+	}
+}
+
+// memoryConsumer consumes a topic of the memory broker
+// Nacked messages are put back first in the topic, or dropped without requeue, and those not acked yet when the
+// consumer is closed are put back first too, as a consumer of another broker that stopped would get them back
+type memoryConsumer struct {
+	topic    *MemoryTopic
+	messages chan Message
+	closed   chan struct{}
+	once     sync.Once
+
+	lock sync.Mutex
+	// unacked are the messages delivered and not settled yet, by delivery sequence
+	unacked map[uint64]string
+	seq     uint64
+}
+
+// prepareMemory prepares a consumer of the memory topic of conf
+func prepareMemory(conf Conf) *memoryConsumer {
+	c := &memoryConsumer{
+		topic:    Memory(conf.Topic),
+		messages: make(chan Message),
+		closed:   make(chan struct{}),
+		unacked:  make(map[uint64]string),
+	}
+	go c.consume()
+	return c
+}
+
+func (c *memoryConsumer) Messages() <-chan Message {
+	return c.messages
+}
+
+// Close stops consuming and puts back the messages delivered and not acked yet, acking them later does nothing
+func (c *memoryConsumer) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.lock.Lock()
+		seqs := make([]uint64, 0, len(c.unacked))
+		for seq := range c.unacked {
+			seqs = append(seqs, seq)
+		}
+		sort.Slice(seqs, func(i, j int) bool { return seqs[i] > seqs[j] })
+		// the newest first, so the oldest ends up first in the topic
+		for _, seq := range seqs {
+			c.topic.requeue(c.unacked[seq])
+		}
+		c.unacked = map[uint64]string{}
+		c.lock.Unlock()
+	})
+	return nil
+}
+
+// consume delivers the messages of the topic until the consumer is closed
+func (c *memoryConsumer) consume() {
+	for {
+		body, ok := c.topic.take()
+		if !ok {
+			select {
+			case <-c.topic.published:
+				continue
+			case <-c.closed:
+				return
+			}
+		}
+		msg := c.message(body)
+		select {
+		case c.messages <- msg:
+		case <-c.closed:
+			// unless Close put it back already
+			msg.Nack(true)
+			return
+		}
+	}
+}
+
+// message tracks a message until it is settled, nacking it with requeue puts it back first in the topic
+func (c *memoryConsumer) message(body string) Message {
+	c.lock.Lock()
+	c.seq++
+	seq := c.seq
+	c.unacked[seq] = body
+	c.lock.Unlock()
+	return Message{
+		Body: body,
+		ack:  func() { c.settle(seq) },
+		nack: func(requeue bool) {
+			if c.settle(seq) && requeue {
+				c.topic.requeue(body)
+			}
+		},
+	}
+}
+
+// settle stops tracking a message, returns false if it was already settled or put back on close
+func (c *memoryConsumer) settle(seq uint64) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, ok := c.unacked[seq]
+	delete(c.unacked, seq)
+	return ok
+}
@@ -0,0 +1,213 @@
+package broker
+
+import (
+	"errors"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+// natsFetchBatch is how many messages are fetched at once from the durable consumer
+const natsFetchBatch = 64
+
+// natsFetchWait is how long a fetch waits for messages, before it is sent again
+const natsFetchWait = 5 * time.Second
+
+// natsConsumer consumes a subject through a JetStream durable pull consumer
+// Its members share the messages of the durable consumer, which are acked one by one and delivered again if they
+// are not acked in time. The client reconnects by itself when its connection is lost
+type natsConsumer struct {
+	conn     *nats.Conn
+	sub      *nats.Subscription
+	messages chan Message
+	states   chan StateChange
+	closed   chan struct{}
+}
+
+// prepareNats prepares a consumer of the subject of conf, creating its durable consumer if it does not exist
+// A new durable consumer starts from ReplayFrom if set, otherwise from StartOffset
+func prepareNats(conf Conf) *natsConsumer {
+	c := &natsConsumer{
+		messages: make(chan Message),
+		states:   make(chan StateChange, 16),
+		closed:   make(chan struct{}),
+	}
+	conn, err := nats.Connect(conf.Host,
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(conf.ReconnectBackoff),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			select {
+			case <-c.closed:
+				// closing the connection disconnects it too
+				return
+			default:
+			}
+			log.Warning("Lost nats connection, reconnecting: ", err)
+			c.notify(StateChange{State: StateDisconnected, Err: err})
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			log.Infoln("Reconnected to nats at", conn.ConnectedUrl())
+			c.notify(StateChange{State: StateConnected})
+		}),
+	)
+	if err != nil {
+		panic(err)
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		panic(err)
+	}
+
+	opts := []nats.SubOpt{nats.AckExplicit()}
+	switch {
+	case conf.ReplayFrom != "":
+		from, err := time.Parse(time.RFC3339, conf.ReplayFrom)
+		if err != nil {
+			panic(err)
+		}
+		opts = append(opts, nats.StartTime(from))
+	case conf.StartOffset == "latest":
+		opts = append(opts, nats.DeliverNew())
+	default:
+		opts = append(opts, nats.DeliverAll())
+	}
+	if conf.Prefetch > 0 {
+		opts = append(opts, nats.MaxAckPending(conf.Prefetch))
+	}
+	sub, err := js.PullSubscribe(conf.Topic, conf.Group, opts...)
+	if err != nil {
+		panic(err)
+	}
+	c.conn, c.sub = conn, sub
+	log.Infoln("Consuming from nats subject", conf.Topic, "as durable consumer", conf.Group)
+	go c.consume()
+	return c
+}
+
+func (c *natsConsumer) Messages() <-chan Message {
+	return c.messages
+}
+
+func (c *natsConsumer) States() <-chan StateChange {
+	return c.states
+}
+
+// Close closes the connection, the durable consumer delivers the messages not acked again once their ack wait is over
+func (c *natsConsumer) Close() error {
+	select {
+	case <-c.closed:
+		return nil
+	default:
+	}
+	close(c.closed)
+	c.conn.Close()
+	return nil
+}
+
+// consume fetches messages from the durable consumer until the consumer is closed
+func (c *natsConsumer) consume() {
+	for {
+		msgs, err := c.sub.Fetch(natsFetchBatch, nats.MaxWait(natsFetchWait))
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+		if err != nil && !errors.Is(err, nats.ErrTimeout) {
+			log.Warning("Error fetching from nats:", err)
+			time.Sleep(natsFetchWait)
+			continue
+		}
+		for _, m := range msgs {
+			select {
+			case c.messages <- natsMessage(m):
+			case <-c.closed:
+				return
+			}
+		}
+	}
+}
+
+// natsMessage wraps a message, nacking it without requeuing terminates it so it is not delivered again
+func natsMessage(m *nats.Msg) Message {
+	return Message{
+		Body: string(m.Data),
+		ack: func() {
+			if err := m.Ack(); err != nil {
+				log.Warning("Error acking nats message:", err)
+			}
+		},
+		nack: func(requeue bool) {
+			var err error
+			if requeue {
+				err = m.Nak()
+			} else {
+				err = m.Term()
+			}
+			if err != nil {
+				log.Warning("Error nacking nats message:", err)
+			}
+		},
+	}
+}
+
+// notify tells the caller the connection changed, unless it is behind on the previous changes
+func (c *natsConsumer) notify(change StateChange) {
+	select {
+	case c.states <- change:
+	default:
+	}
+}
+
+// natsPublishTimeout is how long the acks of a batch published to JetStream are waited for
+const natsPublishTimeout = 30 * time.Second
+
+// natsPublisher publishes batches to a JetStream subject
+type natsPublisher struct {
+	conn    *nats.Conn
+	js      nats.JetStreamContext
+	subject string
+}
+
+// prepareNatsPublisher prepares a connection to publish to the subject of conf, the stream storing it must exist
+func prepareNatsPublisher(conf Conf) *natsPublisher {
+	conn, err := nats.Connect(conf.Host, nats.MaxReconnects(-1), nats.ReconnectWait(conf.ReconnectBackoff))
+	if err != nil {
+		panic(err)
+	}
+	js, err := conn.JetStream()
+	if err != nil {
+		panic(err)
+	}
+	return &natsPublisher{conn: conn, js: js, subject: conf.Topic}
+}
+
+// PublishBatch publishes the messages asynchronously and waits for the stream to ack all of them
+func (p *natsPublisher) PublishBatch(bodies [][]byte) error {
+	futures := make([]nats.PubAckFuture, 0, len(bodies))
+	for _, body := range bodies {
+		f, err := p.js.PublishAsync(p.subject, body)
+		if err != nil {
+			return err
+		}
+		futures = append(futures, f)
+	}
+	timeout := time.After(natsPublishTimeout)
+	for _, f := range futures {
+		select {
+		case <-f.Ok():
+		case err := <-f.Err():
+			return err
+		case <-timeout:
+			return errors.New("timed out waiting for the stream to ack the batch")
+		}
+	}
+	return nil
+}
+
+// Close closes the connection
+func (p *natsPublisher) Close() error {
+	p.conn.Close()
+	return nil
+}
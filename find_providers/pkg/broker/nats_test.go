@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// natsTestConf starts an in-process nats server with JetStream and a stream of the subject, stopped with the test
+func natsTestConf(t *testing.T) Conf {
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(10 * time.Second) {
+		t.Fatal("nats server did not start")
+	}
+	t.Cleanup(srv.Shutdown)
+
+	conf := Conf{
+		Host:             srv.ClientURL(),
+		Topic:            "gateway-logs",
+		Group:            "controllers",
+		StartOffset:      "earliest",
+		ReconnectBackoff: 100 * time.Millisecond,
+	}
+	conn, err := nats.Connect(conf.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	js, err := conn.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "logs", Subjects: []string{conf.Topic}}); err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+// publishNats publishes the bodies to the subject of conf
+func publishNats(t *testing.T, conf Conf, bodies ...string) {
+	t.Helper()
+	publisher := prepareNatsPublisher(conf)
+	defer publisher.Close()
+	batch := make([][]byte, len(bodies))
+	for i, body := range bodies {
+		batch[i] = []byte(body)
+	}
+	if err := publisher.PublishBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNatsDurableConsumerRedeliversNacks(t *testing.T) {
+	conf := natsTestConf(t)
+	publishNats(t, conf, "a", "b")
+
+	consumer := prepareNats(conf)
+	expectMessage(t, consumer, "a", 10*time.Second).Ack()
+	expectMessage(t, consumer, "b", 10*time.Second).Nack(true)
+	expectMessage(t, consumer, "b", 10*time.Second).Ack()
+	expectNoMessage(t, consumer, time.Second)
+	_ = consumer.Close()
+
+	// the durable consumer resumes after the acked messages
+	publishNats(t, conf, "c")
+	consumer = prepareNats(conf)
+	defer consumer.Close()
+	expectMessage(t, consumer, "c", 10*time.Second).Ack()
+	expectNoMessage(t, consumer, time.Second)
+}
+
+func TestNatsNackWithoutRequeueIsNotDelivered(t *testing.T) {
+	conf := natsTestConf(t)
+	publishNats(t, conf, "a", "b")
+
+	consumer := prepareNats(conf)
+	defer consumer.Close()
+	expectMessage(t, consumer, "a", 10*time.Second).Nack(false)
+	expectMessage(t, consumer, "b", 10*time.Second).Ack()
+	expectNoMessage(t, consumer, time.Second)
+}
+
+func TestNatsReplayFrom(t *testing.T) {
+	conf := natsTestConf(t)
+	publishNats(t, conf, "before")
+	time.Sleep(10 * time.Millisecond)
+	from := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	publishNats(t, conf, "after")
+
+	conf.Group = "replay"
+	conf.ReplayFrom = from.Format(time.RFC3339Nano)
+	consumer := prepareNats(conf)
+	defer consumer.Close()
+	expectMessage(t, consumer, "after", 10*time.Second).Ack()
+	expectNoMessage(t, consumer, time.Second)
+}
@@ -1,26 +1,161 @@
 package broker
 
-import "github.com/streadway/amqp"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
 
-// consumeRabbitMq consumes messages from a RabbitMQ broker
-func consumeRabbitMq(msgs <-chan amqp.Delivery, logCh chan string) {
-	for m := range msgs {
-		logCh <- string(m.Body)
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// rabbitMqConsumer consumes messages from a RabbitMQ queue, acking them manually
+// It reconnects with an exponential backoff whenever its connection or channel is lost, the messages not acked
+// then are delivered again by the broker
+type rabbitMqConsumer struct {
+	conf     Conf
+	tag      string
+	messages chan Message
+	states   chan StateChange
+	closed   chan struct{}
+
+	lock sync.Mutex
+	conn *amqp.Connection
+}
+
+// prepareRabbitMq prepares a consumer of the queue of conf, which keeps connecting until it is closed
+func prepareRabbitMq(conf Conf) *rabbitMqConsumer {
+	tag := conf.ConsumerTag
+	if tag == "" {
+		host, _ := os.Hostname()
+		tag = fmt.Sprintf("%v-%d", host, os.Getpid())
 	}
+	c := &rabbitMqConsumer{
+		conf:     conf,
+		tag:      tag,
+		messages: make(chan Message),
+		states:   make(chan StateChange, 16),
+		closed:   make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *rabbitMqConsumer) Messages() <-chan Message {
+	return c.messages
 }
 
-// prepareRabbitMq prepares a connection to a RabbitMQ broker
-func prepareRabbitMq(rabbitmqHost, groupId string) <-chan amqp.Delivery {
-	conn, err := amqp.Dial(rabbitmqHost)
+func (c *rabbitMqConsumer) States() <-chan StateChange {
+	return c.states
+}
+
+// Close closes the connection to the broker, which requeues the messages not acked
+func (c *rabbitMqConsumer) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	select {
+	case <-c.closed:
+		return nil
+	default:
+	}
+	close(c.closed)
+	if c.conn == nil || c.conn.IsClosed() {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// run consumes until the consumer is closed, connecting again after the backoff whenever the connection is lost
+func (c *rabbitMqConsumer) run() {
+	backoff := c.conf.ReconnectBackoff
+	for {
+		deliveries, closing, err := c.connect()
+		var redeclared *queueRedeclaredError
+		if errors.As(err, &redeclared) {
+			// connecting again declares the queue again, which fails again
+			log.Error("Stopped consuming: ", err)
+			select {
+			case c.states <- StateChange{State: StateFailed, Err: err}:
+			case <-c.closed:
+			}
+			return
+		}
+		if err == nil {
+			backoff = c.conf.ReconnectBackoff
+			log.Infoln("Consuming from rabbitmq queue", c.conf.Topic, "as", c.tag)
+			c.notify(StateChange{State: StateConnected})
+			c.consume(deliveries)
+			err = errors.New("channel closed")
+			if amqpErr := <-closing; amqpErr != nil {
+				err = amqpErr
+			}
+		}
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+
+		log.Warning("Lost rabbitmq connection, reconnecting in ", backoff, ": ", err)
+		c.notify(StateChange{State: StateDisconnected, Err: err})
+		select {
+		case <-time.After(backoff):
+		case <-c.closed:
+			return
+		}
+		backoff *= 2
+		if backoff > c.conf.ReconnectBackoffMax {
+			backoff = c.conf.ReconnectBackoffMax
+		}
+	}
+}
+
+// connect connects to the broker, declares the topology and starts consuming
+// Returns the deliveries and the channel notified once they stop
+func (c *rabbitMqConsumer) connect() (<-chan amqp.Delivery, chan *amqp.Error, error) {
+	conn, err := amqp.Dial(c.conf.Host)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
+	}
+	deliveries, closing, err := c.consumeChannel(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	select {
+	case <-c.closed:
+		_ = conn.Close()
+		return nil, nil, errors.New("consumer closed")
+	default:
 	}
+	if c.conn != nil && !c.conn.IsClosed() {
+		_ = c.conn.Close()
+	}
+	c.conn = conn
+	return deliveries, closing, nil
+}
+
+// consumeChannel opens a channel consuming from the queue, at most Prefetch messages are delivered and not acked
+func (c *rabbitMqConsumer) consumeChannel(conn *amqp.Connection) (<-chan amqp.Delivery, chan *amqp.Error, error) {
 	ch, err := conn.Channel()
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
-	q, err := ch.QueueDeclare(
-		groupId,
+	if err := declareRabbitMq(ch, c.conf); err != nil {
+		return nil, nil, err
+	}
+	if err := ch.Qos(c.conf.Prefetch, 0, false); err != nil {
+		return nil, nil, err
+	}
+	closing := ch.NotifyClose(make(chan *amqp.Error, 1))
+	deliveries, err := ch.Consume(
+		c.conf.Topic,
+		c.tag,
 		false,
 		false,
 		false,
@@ -28,19 +163,286 @@ func prepareRabbitMq(rabbitmqHost, groupId string) <-chan amqp.Delivery {
 		nil,
 	)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
-	msgs, err := ch.Consume(
-		q.Name,
-		"",
+	return deliveries, closing, nil
+}
+
+// consume hands the deliveries over as messages acked on the broker, until they stop or the consumer is closed
+func (c *rabbitMqConsumer) consume(deliveries <-chan amqp.Delivery) {
+	for d := range deliveries {
+		select {
+		case c.messages <- rabbitMqMessage(d):
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// rabbitMqMessage wraps a delivery, acks of a delivery whose channel was lost fail and it is delivered again
+func rabbitMqMessage(d amqp.Delivery) Message {
+	return Message{
+		Body: string(d.Body),
+		ack: func() {
+			if err := d.Ack(false); err != nil {
+				log.Warning("Error acking rabbitmq message:", err)
+			}
+		},
+		nack: func(requeue bool) {
+			if err := d.Nack(false, requeue); err != nil {
+				log.Warning("Error nacking rabbitmq message:", err)
+			}
+		},
+	}
+}
+
+// notify tells the caller the connection changed, unless it is behind on the previous changes
+func (c *rabbitMqConsumer) notify(change StateChange) {
+	select {
+	case c.states <- change:
+	default:
+	}
+}
+
+// queueRedeclaredError tells that the queue exists with other properties, e.g. non-durable as declared by earlier
+// versions, and has to be deleted before it is declared again
+type queueRedeclaredError struct {
+	queue string
+	err   *amqp.Error
+}
+
+func (e *queueRedeclaredError) Error() string {
+	return fmt.Sprintf("rabbitmq queue %v exists with other properties, delete it (rabbitmqctl delete_queue %v) "+
+		"or consume from another broker.topic: %v", e.queue, e.queue, e.err)
+}
+
+// declareRabbitMq declares the durable queue of the topic and, with an exchange, the durable direct exchange the
+// queue is bound to by the name of the topic
+func declareRabbitMq(ch *amqp.Channel, conf Conf) error {
+	_, err := ch.QueueDeclare(
+		conf.Topic,
 		true,
 		false,
 		false,
 		false,
 		nil,
 	)
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+		return &queueRedeclaredError{queue: conf.Topic, err: amqpErr}
+	}
+	if err != nil || conf.Exchange == "" {
+		return err
+	}
+	err = ch.ExchangeDeclare(
+		conf.Exchange,
+		"direct",
+		true,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	return ch.QueueBind(conf.Topic, conf.Topic, conf.Exchange, false, nil)
+}
+
+// rabbitMqQueue publishes messages to and pulls messages from a RabbitMQ queue
+// It connects again on the next call once its connection is lost
+type rabbitMqQueue struct {
+	conf Conf
+
+	lock sync.Mutex
+	conn *amqp.Connection
+	ch   *amqp.Channel
+}
+
+// prepareRabbitMqQueue prepares a connection to publish to and pull from the queue of conf
+func prepareRabbitMqQueue(conf Conf) *rabbitMqQueue {
+	q := &rabbitMqQueue{conf: conf}
+	if _, err := q.channel(); err != nil {
+		panic(err)
+	}
+	return q
+}
+
+// channel returns the channel to the broker, connecting again if the connection was lost
+func (q *rabbitMqQueue) channel() (*amqp.Channel, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.conn != nil && !q.conn.IsClosed() {
+		return q.ch, nil
+	}
+	conn, err := amqp.Dial(q.conf.Host)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err == nil {
+		// declared as the consumers declare it
+		err = declareRabbitMq(ch, q.conf)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	q.conn, q.ch = conn, ch
+	return ch, nil
+}
+
+// Publish publishes a persistent message to the queue, through the exchange if there is one
+func (q *rabbitMqQueue) Publish(body []byte) error {
+	ch, err := q.channel()
+	if err != nil {
+		return err
+	}
+	return ch.Publish(
+		q.conf.Exchange,
+		q.conf.Topic,
+		false,
+		false,
+		amqp.Publishing{DeliveryMode: amqp.Persistent, Body: body},
+	)
+}
+
+// Pull calls f with the next message of the queue, acking it if f succeeds and requeuing it otherwise
+func (q *rabbitMqQueue) Pull(f func(body []byte) error) (bool, error) {
+	ch, err := q.channel()
+	if err != nil {
+		return false, err
+	}
+	m, ok, err := ch.Get(q.conf.Topic, false)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err := f(m.Body); err != nil {
+		if nackErr := m.Nack(false, true); nackErr != nil {
+			return true, nackErr
+		}
+		return true, err
+	}
+	return true, m.Ack(false)
+}
+
+// Len returns how many messages are ready in the queue
+func (q *rabbitMqQueue) Len() (int, error) {
+	ch, err := q.channel()
 	if err != nil {
+		return 0, err
+	}
+	state, err := ch.QueueInspect(q.conf.Topic)
+	return state.Messages, err
+}
+
+// Close closes the connection to the broker
+func (q *rabbitMqQueue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.conn == nil || q.conn.IsClosed() {
+		return nil
+	}
+	return q.conn.Close()
+}
+
+// rabbitMqPublisher publishes confirmed batches to a RabbitMQ queue
+// It connects again on the next batch once its connection is lost
+type rabbitMqPublisher struct {
+	conf     Conf
+	conn     *amqp.Connection
+	ch       *amqp.Channel
+	confirms chan amqp.Confirmation
+}
+
+// prepareRabbitMqPublisher prepares a connection in confirm mode to publish to the queue of conf
+func prepareRabbitMqPublisher(conf Conf) *rabbitMqPublisher {
+	p := &rabbitMqPublisher{conf: conf}
+	if err := p.connect(); err != nil {
 		panic(err)
 	}
-	return msgs
+	return p
+}
+
+// connect connects to the broker unless connected, and puts the channel in confirm mode
+func (p *rabbitMqPublisher) connect() error {
+	if p.conn != nil && !p.conn.IsClosed() {
+		return nil
+	}
+	conn, err := amqp.Dial(p.conf.Host)
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err == nil {
+		// declared as the consumers declare it
+		err = declareRabbitMq(ch, p.conf)
+	}
+	if err == nil {
+		err = ch.Confirm(false)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	p.conn, p.ch = conn, ch
+	p.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	return nil
+}
+
+// PublishBatch publishes persistent messages to the queue, through the exchange if there is one, and waits for the
+// broker to confirm all of them
+func (p *rabbitMqPublisher) PublishBatch(bodies [][]byte) error {
+	if err := p.connect(); err != nil {
+		return err
+	}
+	confirmed := make(chan error, 1)
+	go func() { confirmed <- waitConfirms(p.confirms, len(bodies)) }()
+	for _, body := range bodies {
+		err := p.ch.Publish(
+			p.conf.Exchange,
+			p.conf.Topic,
+			false,
+			false,
+			amqp.Publishing{DeliveryMode: amqp.Persistent, Body: body},
+		)
+		if err != nil {
+			// closing stops waiting for the confirms, the next batch connects again
+			_ = p.conn.Close()
+			<-confirmed
+			return err
+		}
+	}
+	err := <-confirmed
+	if err != nil {
+		// the channel may be closed while the connection is not, the next batch connects again
+		_ = p.conn.Close()
+	}
+	return err
+}
+
+// waitConfirms waits for n publisher confirms, returning an error if any message was nacked or the channel closed
+func waitConfirms(confirms chan amqp.Confirmation, n int) error {
+	nacked := 0
+	for i := 0; i < n; i++ {
+		c, ok := <-confirms
+		if !ok {
+			return errors.New("channel closed before confirming the batch")
+		}
+		if !c.Ack {
+			nacked++
+		}
+	}
+	if nacked > 0 {
+		return fmt.Errorf("broker nacked %d of %d messages", nacked, n)
+	}
+	return nil
+}
+
+// Close closes the connection to the broker
+func (p *rabbitMqPublisher) Close() error {
+	if p.conn == nil || p.conn.IsClosed() {
+		return nil
+	}
+	return p.conn.Close()
 }
@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// LookupCache remembers the cids whose providers were looked up recently, to avoid repeating DHT lookups
+// It holds at most size cids, evicting the least recently used, and forgets a cid ttl after its lookup, or
+// negativeTTL after a lookup that found no provider
+type LookupCache struct {
+	lock        sync.Mutex
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	order       *list.List
+	entries     map[string]*list.Element
+
+	hits      int64
+	misses    int64
+	evictions int64
+	expired   int64
+}
+
+// Stats are the counters of a LookupCache
+type Stats struct {
+	Size      int
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Expired   int64
+}
+
+type lookupEntry struct {
+	cid string
+	at  time.Time
+	ttl time.Duration
+}
+
+// NewLookupCache creates a cache holding at most size cids for ttl each, or negativeTTL for those without providers
+func NewLookupCache(size int, ttl time.Duration, negativeTTL time.Duration) *LookupCache {
+	return &LookupCache{
+		size:        size,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		order:       list.New(),
+		entries:     make(map[string]*list.Element),
+	}
+}
+
+// Contains checks if the providers of the cid were looked up less than ttl ago
+func (c *LookupCache) Contains(cid string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	el, ok := c.entries[cid]
+	if ok && c.isExpired(el, time.Now()) {
+		c.remove(el)
+		c.expired++
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return false
+	}
+	c.hits++
+	c.order.MoveToFront(el)
+	return true
+}
+
+// Add records that the providers of the cid were looked up at the given time
+// Returns false if the cid was already in the cache and had not expired, in which case it is left untouched
+func (c *LookupCache) Add(cid string, at time.Time) bool {
+	return c.add(cid, at, c.ttl)
+}
+
+// AddNegative records that the cid was looked up at the given time without finding any provider, it is forgotten
+// after negativeTTL. Returns false if the cid was already in the cache and had not expired, as Add
+func (c *LookupCache) AddNegative(cid string, at time.Time) bool {
+	return c.add(cid, at, c.negativeTTL)
+}
+
+// add records the lookup of the cid at the given time, forgotten after ttl
+func (c *LookupCache) add(cid string, at time.Time, ttl time.Duration) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, ok := c.entries[cid]; ok {
+		if !c.isExpired(el, time.Now()) {
+			return false
+		}
+		entry := el.Value.(*lookupEntry)
+		entry.at, entry.ttl = at, ttl
+		c.order.MoveToFront(el)
+		return true
+	}
+	c.entries[cid] = c.order.PushFront(&lookupEntry{cid: cid, at: at, ttl: ttl})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+		c.evictions++
+	}
+	return true
+}
+
+// Loader calls f for the cids looked up since the given time, at most limit of them, from the oldest to the newest
+type Loader func(since time.Time, limit int, f func(cid string, at time.Time)) (int, error)
+
+// Warm adds the cids looked up less than ttl ago that load finds, and returns how many were loaded
+func (c *LookupCache) Warm(load Loader) (int, error) {
+	return load(time.Now().Add(-c.ttl), c.size, func(cid string, at time.Time) { c.Add(cid, at) })
+}
+
+// Remove forgets the cid, so its providers are looked up again
+func (c *LookupCache) Remove(cid string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if el, ok := c.entries[cid]; ok {
+		c.remove(el)
+	}
+}
+
+// Prune removes the expired cids from the cache and returns how many were removed
+func (c *LookupCache) Prune() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	removed := 0
+	for el := c.order.Back(); el != nil; {
+		prev := el.Prev()
+		if c.isExpired(el, now) {
+			c.remove(el)
+			removed++
+		}
+		el = prev
+	}
+	c.expired += int64(removed)
+	return removed
+}
+
+// Stats returns the current counters of the cache
+func (c *LookupCache) Stats() Stats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return Stats{
+		Size:      c.order.Len(),
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Expired:   c.expired,
+	}
+}
+
+// isExpired checks if the entry in el is older than its ttl at now
+func (c *LookupCache) isExpired(el *list.Element, now time.Time) bool {
+	entry := el.Value.(*lookupEntry)
+	return now.After(entry.at.Add(entry.ttl))
+}
+
+// remove removes el from the cache
+func (c *LookupCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*lookupEntry).cid)
+}
@@ -0,0 +1,154 @@
+package cache
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestContains(t *testing.T) {
+	now := time.Now()
+	for _, c := range []struct {
+		name     string
+		add      func(c *LookupCache)
+		contains bool
+		stats    Stats
+	}{
+		{name: "never looked up", add: func(*LookupCache) {}, stats: Stats{Misses: 1}},
+		{
+			name:     "looked up",
+			add:      func(c *LookupCache) { c.Add("a", now.Add(-30*time.Minute)) },
+			contains: true,
+			stats:    Stats{Size: 1, Hits: 1},
+		},
+		{
+			name:  "expired",
+			add:   func(c *LookupCache) { c.Add("a", now.Add(-2*time.Hour)) },
+			stats: Stats{Misses: 1, Expired: 1},
+		},
+		{
+			name:  "without providers expired",
+			add:   func(c *LookupCache) { c.AddNegative("a", now.Add(-30*time.Minute)) },
+			stats: Stats{Misses: 1, Expired: 1},
+		},
+		{
+			name:     "without providers",
+			add:      func(c *LookupCache) { c.AddNegative("a", now.Add(-5*time.Minute)) },
+			contains: true,
+			stats:    Stats{Size: 1, Hits: 1},
+		},
+		{
+			name: "removed",
+			add: func(c *LookupCache) {
+				c.Add("a", now)
+				c.Remove("a")
+			},
+			stats: Stats{Misses: 1},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cache := NewLookupCache(10, time.Hour, 10*time.Minute)
+			c.add(cache)
+			if contains := cache.Contains("a"); contains != c.contains {
+				t.Fatalf("got %v, expected %v", contains, c.contains)
+			}
+			if st := cache.Stats(); st != c.stats {
+				t.Fatalf("got %+v, expected %+v", st, c.stats)
+			}
+		})
+	}
+}
+
+func TestAdd(t *testing.T) {
+	c := NewLookupCache(10, time.Hour, 10*time.Minute)
+	now := time.Now()
+	if !c.Add("a", now.Add(-2*time.Hour)) {
+		t.Fatal("did not add a new cid")
+	}
+	// an expired cid is looked up again
+	if !c.Add("a", now.Add(-30*time.Minute)) {
+		t.Fatal("did not renew an expired cid")
+	}
+	if c.Add("a", now) || c.AddNegative("a", now) {
+		t.Fatal("renewed a cid that had not expired")
+	}
+	// left untouched, it expires an hour after the renewed lookup
+	c.lock.Lock()
+	at := c.entries["a"].Value.(*lookupEntry).at
+	c.lock.Unlock()
+	if !at.Equal(now.Add(-30 * time.Minute)) {
+		t.Fatalf("got lookup at %v, expected %v", at, now.Add(-30*time.Minute))
+	}
+}
+
+func TestEvictsTheLeastRecentlyUsed(t *testing.T) {
+	c := NewLookupCache(3, time.Hour, time.Hour)
+	now := time.Now()
+	for _, cid := range []string{"a", "b", "c"} {
+		c.Add(cid, now)
+	}
+	// a is used, b becomes the least recently used
+	c.Contains("a")
+	c.Add("d", now)
+	c.Add("e", now)
+	for cid, expected := range map[string]bool{"a": true, "b": false, "c": false, "d": true, "e": true} {
+		if contains := c.Contains(cid); contains != expected {
+			t.Errorf("got %v for %v, expected %v", contains, cid, expected)
+		}
+	}
+	if st := c.Stats(); st != (Stats{Size: 3, Hits: 4, Misses: 2, Evictions: 2}) {
+		t.Fatalf("got %+v, expected 2 evictions", st)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	c := NewLookupCache(10, time.Hour, 10*time.Minute)
+	now := time.Now()
+	c.Add("expired", now.Add(-2*time.Hour))
+	c.Add("live", now.Add(-30*time.Minute))
+	c.AddNegative("negative expired", now.Add(-30*time.Minute))
+	c.AddNegative("negative live", now.Add(-5*time.Minute))
+	if removed := c.Prune(); removed != 2 {
+		t.Fatalf("pruned %v cids, expected 2", removed)
+	}
+	if st := c.Stats(); st != (Stats{Size: 2, Expired: 2}) {
+		t.Fatalf("got %+v, expected 2 cids left and 2 expired", st)
+	}
+	if removed := c.Prune(); removed != 0 {
+		t.Fatalf("pruned %v cids again, expected none", removed)
+	}
+}
+
+func TestWarm(t *testing.T) {
+	c := NewLookupCache(2, time.Hour, 10*time.Minute)
+	now := time.Now()
+	var since time.Time
+	var limit int
+	n, err := c.Warm(func(s time.Time, l int, f func(cid string, at time.Time)) (int, error) {
+		since, limit = s, l
+		// from the oldest to the newest, more than the cache holds
+		for i, cid := range []string{"a", "b", "c"} {
+			f(cid, now.Add(time.Duration(i-3)*time.Minute))
+		}
+		return 3, nil
+	})
+	if err != nil || n != 3 {
+		t.Fatalf("got (%v, %v), expected 3 cids loaded", n, err)
+	}
+	if since.Before(now.Add(-time.Hour)) || since.After(time.Now().Add(-time.Hour)) || limit != 2 {
+		t.Fatalf("loaded since %v, at most %v, expected the cids of the last hour, at most 2", since, limit)
+	}
+	var contains []bool
+	for _, cid := range []string{"a", "b", "c"} {
+		contains = append(contains, c.Contains(cid))
+	}
+	if !reflect.DeepEqual(contains, []bool{false, true, true}) {
+		t.Fatalf("got %v, expected the newest cids to be kept", contains)
+	}
+
+	failed := errors.New("no database")
+	if _, err := c.Warm(func(time.Time, int, func(string, time.Time)) (int, error) { return 0, failed }); err != failed {
+		t.Fatalf("got %v, expected %v", err, failed)
+	}
+}
@@ -0,0 +1,101 @@
+package claim
+
+import (
+	"find_providers/pkg/db"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Claimer decides which of the controllers consuming the same logs looks up a cid
+type Claimer interface {
+	// Claim claims the lookup of the cid, returns false and until when the current claim holds if someone else has it
+	Claim(cid string) (bool, time.Time, error)
+	// Hold keeps the claim on a looked up cid that found that many providers, so nobody looks it up again until its
+	// cached providers expire, or its cached lookup without providers
+	Hold(cid string, providers int) error
+	// Release gives up the claim on a cid, so anyone can look it up again
+	Release(cid string) error
+	// Prune forgets the expired claims
+	Prune() error
+}
+
+// store keeps the claims, as the lookup_claims table of the database
+type store interface {
+	ClaimLookup(cid, owner string, lease time.Duration) (bool, time.Time, error)
+	HoldLookupClaim(cid, owner string, hold time.Duration) error
+	ReleaseLookupClaim(cid, owner string) error
+	PruneLookupClaims() (int64, error)
+}
+
+// PrepareClaimer prepares the claimer selected by conf, claims of looked up cids are held for hold, or negativeHold
+// if no provider was found
+func PrepareClaimer(conf Conf, hold, negativeHold time.Duration, dbAPI *db.DB) Claimer {
+	switch conf.Type {
+	case "postgres":
+		owner := conf.Owner
+		if owner == "" {
+			host, _ := os.Hostname()
+			owner = fmt.Sprintf("%v-%d", host, os.Getpid())
+		}
+		log.Infoln("Claiming lookups in postgres as", owner)
+		return &postgresClaimer{store: dbAPI, owner: owner, lease: conf.Lease, hold: hold, negativeHold: negativeHold}
+	default:
+		return localClaimer{}
+	}
+}
+
+// localClaimer claims every cid, the controller deduplicates its own lookups
+type localClaimer struct{}
+
+func (localClaimer) Claim(string) (bool, time.Time, error) {
+	return true, time.Time{}, nil
+}
+
+func (localClaimer) Hold(string, int) error {
+	return nil
+}
+
+func (localClaimer) Release(string) error {
+	return nil
+}
+
+func (localClaimer) Prune() error {
+	return nil
+}
+
+// postgresClaimer claims cids in the lookup_claims table shared by the controllers
+type postgresClaimer struct {
+	store        store
+	owner        string
+	lease        time.Duration
+	hold         time.Duration
+	negativeHold time.Duration
+}
+
+func (c *postgresClaimer) Claim(cid string) (bool, time.Time, error) {
+	return c.store.ClaimLookup(cid, c.owner, c.lease)
+}
+
+// Hold holds the claim for as long as the controllers cache the lookup, as a claimed cid is cached until its claim expires
+func (c *postgresClaimer) Hold(cid string, providers int) error {
+	hold := c.hold
+	if providers == 0 {
+		hold = c.negativeHold
+	}
+	return c.store.HoldLookupClaim(cid, c.owner, hold)
+}
+
+func (c *postgresClaimer) Release(cid string) error {
+	return c.store.ReleaseLookupClaim(cid, c.owner)
+}
+
+func (c *postgresClaimer) Prune() error {
+	n, err := c.store.PruneLookupClaims()
+	if err == nil {
+		log.Debug("Pruned ", n, " expired lookup claims")
+	}
+	return err
+}
@@ -0,0 +1,44 @@
+package claim
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeStore records the claims held, by cid
+type fakeStore struct {
+	held map[string]time.Duration
+}
+
+func (s *fakeStore) ClaimLookup(string, string, time.Duration) (bool, time.Time, error) {
+	return true, time.Time{}, nil
+}
+
+func (s *fakeStore) HoldLookupClaim(cid, _ string, hold time.Duration) error {
+	s.held[cid] = hold
+	return nil
+}
+
+func (s *fakeStore) ReleaseLookupClaim(string, string) error {
+	return nil
+}
+
+func (s *fakeStore) PruneLookupClaims() (int64, error) {
+	return 0, nil
+}
+
+func TestPostgresClaimerHoldsLookupsWithoutProvidersForTheNegativeTTL(t *testing.T) {
+	s := &fakeStore{held: map[string]time.Duration{}}
+	c := &postgresClaimer{store: s, owner: "controller", lease: time.Minute, hold: 24 * time.Hour, negativeHold: time.Hour}
+	for cid, providers := range map[string]int{"found": 3, "not-found": 0} {
+		if err := c.Hold(cid, providers); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.held["found"] != 24*time.Hour {
+		t.Errorf("held a lookup with providers for %v, expected the cache ttl 24h", s.held["found"])
+	}
+	if s.held["not-found"] != time.Hour {
+		t.Errorf("held a lookup without providers for %v, expected the negative cache ttl 1h", s.held["not-found"])
+	}
+}
@@ -0,0 +1,13 @@
+package claim
+
+import "time"
+
+// Conf selects how controllers share the lookups of cids
+type Conf struct {
+	// Type is local, for a single controller, or postgres, for controllers sharing the lookup_claims table
+	Type string `yaml:"type" toml:"type"`
+	// Lease is how long a claim holds while its lookup runs, it should outlast the lookup timeout
+	Lease time.Duration `yaml:"lease" toml:"lease"`
+	// Owner identifies the controller in its claims, the host name and process id by default
+	Owner string `yaml:"owner" toml:"owner"`
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+// binaries are the Validate methods of the binaries
+var binaries = map[string]func(Config) error{
+	"controller": Config.ValidateController,
+	"writer":     Config.ValidateWriter,
+	"service":    Config.ValidateService,
+	"shipper":    Config.ValidateShipper,
+	"migrate":    Config.ValidateMigrate,
+	"redrive":    Config.ValidateRedrive,
+}
+
+func TestDefaultIsValid(t *testing.T) {
+	c := Default()
+	for name, validate := range binaries {
+		if err := validate(c); err != nil {
+			t.Errorf("the %v rejects the default configuration: %v", name, err)
+		}
+	}
+}
+
+func TestValidateChecksTheSettingsOfEachBinary(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		change func(c *Config)
+		// rejecting are the binaries reading the setting changed, which reject it with an error mentioning err,
+		// the others ignore it
+		err       string
+		rejecting []string
+	}{
+		{
+			name:      "controller setting",
+			change:    func(c *Config) { c.Controller.Concurrency = 0 },
+			err:       "controller.concurrency",
+			rejecting: []string{"controller"},
+		},
+		{
+			name:      "batch",
+			change:    func(c *Config) { c.Database.Batch.Size = 0 },
+			err:       "database.batch.size",
+			rejecting: []string{"controller"},
+		},
+		{
+			name:      "database",
+			change:    func(c *Config) { c.Database.Postgres.Host = "" },
+			err:       "database.postgres.host",
+			rejecting: []string{"controller", "writer", "migrate", "redrive"},
+		},
+		{
+			name:      "broker",
+			change:    func(c *Config) { c.Broker.Type = "unknown" },
+			err:       "broker.type",
+			rejecting: []string{"controller", "writer", "shipper", "redrive"},
+		},
+		{
+			name:      "parser url",
+			change:    func(c *Config) { c.Services.ParserUrl = "" },
+			err:       "services.parser_url",
+			rejecting: []string{"controller", "writer"},
+		},
+		{
+			name:      "port",
+			change:    func(c *Config) { c.Services.Port = 0 },
+			err:       "services.port",
+			rejecting: []string{"service"},
+		},
+		{
+			name:      "claims",
+			change:    func(c *Config) { c.Claims.Type = "unknown" },
+			err:       "claims.type",
+			rejecting: []string{"controller"},
+		},
+		{
+			name:      "dead letter",
+			change:    func(c *Config) { c.DeadLetter.Type = "unknown" },
+			err:       "dead_letter.type",
+			rejecting: []string{"controller", "writer", "redrive"},
+		},
+		{
+			name:      "shipper",
+			change:    func(c *Config) { c.Shipper.Paths = nil },
+			err:       "shipper.paths",
+			rejecting: []string{"shipper"},
+		},
+		{
+			name:      "writer",
+			change:    func(c *Config) { c.Writer.Topic = "" },
+			err:       "writer.topic",
+			rejecting: []string{"writer"},
+		},
+		{
+			name:      "prefetch below the batch",
+			change:    func(c *Config) { c.Broker.Prefetch = 10 },
+			err:       "broker.prefetch",
+			rejecting: []string{"controller"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			conf := Default()
+			c.change(&conf)
+			for name, validate := range map[string]func(Config) error{
+				"controller": Config.ValidateController,
+				"writer":     Config.ValidateWriter,
+				"service":    Config.ValidateService,
+				"shipper":    Config.ValidateShipper,
+				"migrate":    Config.ValidateMigrate,
+				"redrive":    Config.ValidateRedrive,
+			} {
+				rejects := false
+				for _, r := range c.rejecting {
+					rejects = rejects || r == name
+				}
+				err := validate(conf)
+				if rejects && (err == nil || !strings.Contains(err.Error(), c.err)) {
+					t.Errorf("the %v got error %v, expected it to mention %q", name, err, c.err)
+				}
+				if !rejects && err != nil {
+					t.Errorf("the %v rejected a setting it does not read: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRedriveChecksTheDatabaseOfTheTableOnly(t *testing.T) {
+	c := Default()
+	c.Database.Postgres.Host = ""
+	c.DeadLetter.Type = "queue"
+	if err := c.ValidateRedrive(); err != nil {
+		t.Fatalf("got error %v, expected the queue re-drive to ignore the database", err)
+	}
+}
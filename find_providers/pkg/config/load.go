@@ -0,0 +1,252 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix is the prefix of the environment variables that override the configuration
+const EnvPrefix = "IPFS_LOC_"
+
+// configFlag is the flag (and, prefixed, the environment variable) holding the path of the configuration file
+const configFlag = "config"
+
+// option binds a configuration field to a flag and an environment variable
+type option struct {
+	name      string
+	shorthand string
+	usage     string
+	field     func(c *Config) interface{}
+}
+
+var options = []option{
+	{name: "db-type", usage: "database to use (postgres or influx)", field: func(c *Config) interface{} { return &c.Database.Type }},
+	{name: "postgres-host", usage: "postgres host", field: func(c *Config) interface{} { return &c.Database.Postgres.Host }},
+	{name: "postgres-port", usage: "postgres port", field: func(c *Config) interface{} { return &c.Database.Postgres.Port }},
+	{name: "postgres-user", usage: "postgres user", field: func(c *Config) interface{} { return &c.Database.Postgres.User }},
+	{name: "postgres-password", usage: "postgres password", field: func(c *Config) interface{} { return &c.Database.Postgres.Password }},
+	{name: "postgres-dbname", usage: "postgres database name", field: func(c *Config) interface{} { return &c.Database.Postgres.DBname }},
+	{name: "postgres-password-file", usage: "file holding the postgres password, read on every new connection", field: func(c *Config) interface{} { return &c.Database.Postgres.PasswordFile }},
+	{name: "postgres-sslmode", usage: "postgres sslmode (disable, allow, prefer, require, verify-ca or verify-full)", field: func(c *Config) interface{} { return &c.Database.Postgres.SSLMode }},
+	{name: "postgres-sslrootcert", usage: "CA certificate verifying the postgres server", field: func(c *Config) interface{} { return &c.Database.Postgres.SSLRootCert }},
+	{name: "postgres-sslcert", usage: "client certificate to authenticate to postgres with", field: func(c *Config) interface{} { return &c.Database.Postgres.SSLCert }},
+	{name: "postgres-sslkey", usage: "key of the postgres client certificate", field: func(c *Config) interface{} { return &c.Database.Postgres.SSLKey }},
+	{name: "postgres-max-open-conns", usage: "how many connections to postgres to open at most (0 is unbounded)", field: func(c *Config) interface{} { return &c.Database.Postgres.MaxOpenConns }},
+	{name: "postgres-max-idle-conns", usage: "how many idle connections to postgres to keep", field: func(c *Config) interface{} { return &c.Database.Postgres.MaxIdleConns }},
+	{name: "postgres-conn-max-lifetime", usage: "close postgres connections this old (0 keeps them)", field: func(c *Config) interface{} { return &c.Database.Postgres.ConnMaxLifetime }},
+	{name: "postgres-conn-max-idle-time", usage: "close postgres connections idle this long (0 keeps them)", field: func(c *Config) interface{} { return &c.Database.Postgres.ConnMaxIdleTime }},
+	{name: "postgres-statement-timeout", usage: "abort postgres statements running longer (0 lets them run)", field: func(c *Config) interface{} { return &c.Database.Postgres.StatementTimeout }},
+	{name: "postgres-migrate", usage: "apply the pending schema migrations at startup, otherwise refuse an outdated schema", field: func(c *Config) interface{} { return &c.Database.Postgres.Migrate }},
+	{name: "influx-org", usage: "influxdb organization", field: func(c *Config) interface{} { return &c.Database.Influx.Org }},
+	{name: "influx-bucket", usage: "influxdb bucket", field: func(c *Config) interface{} { return &c.Database.Influx.Bucket }},
+	{name: "influx-url", usage: "influxdb url", field: func(c *Config) interface{} { return &c.Database.Influx.DBUrl }},
+	{name: "influx-token", usage: "influxdb token", field: func(c *Config) interface{} { return &c.Database.Influx.Token }},
+	{name: "batch-size", usage: "how many rows to buffer before writing them to the database", field: func(c *Config) interface{} { return &c.Database.Batch.Size }},
+	{name: "batch-interval", usage: "how long to buffer rows for at most before writing them to the database", field: func(c *Config) interface{} { return &c.Database.Batch.Interval }},
+	{name: "batch-max-pending", usage: "how many writes to queue for the buffer before pausing the write stage", field: func(c *Config) interface{} { return &c.Database.Batch.MaxPending }},
+	{name: "broker-type", usage: "broker to consume from (rabbitmq, kafka, nats, ingest, memory, filequeue or file)", field: func(c *Config) interface{} { return &c.Broker.Type }},
+	{name: "broker-host", usage: "broker address (rabbitmq or nats url)", field: func(c *Config) interface{} { return &c.Broker.Host }},
+	{name: "broker-topic", usage: "broker topic (or queue) to consume from", field: func(c *Config) interface{} { return &c.Broker.Topic }},
+	{name: "broker-path", usage: "log files to replay with the file broker, separated by commas (- is stdin)", field: func(c *Config) interface{} { return &c.Broker.Path }},
+	{name: "rabbitmq-exchange", usage: "durable exchange the rabbitmq queues are bound to (empty publishes to the queues directly)", field: func(c *Config) interface{} { return &c.Broker.Exchange }},
+	{name: "rabbitmq-prefetch", usage: "rabbitmq messages delivered and not acked at most (0 is unlimited)", field: func(c *Config) interface{} { return &c.Broker.Prefetch }},
+	{name: "rabbitmq-consumer-tag", usage: "rabbitmq consumer tag (default hostname-pid)", field: func(c *Config) interface{} { return &c.Broker.ConsumerTag }},
+	{name: "reconnect-backoff", usage: "wait before reconnecting to rabbitmq, doubled while reconnecting fails", field: func(c *Config) interface{} { return &c.Broker.ReconnectBackoff }},
+	{name: "reconnect-backoff-max", usage: "longest wait before reconnecting to rabbitmq", field: func(c *Config) interface{} { return &c.Broker.ReconnectBackoffMax }},
+	{name: "kafka-brokers", usage: "bootstrap servers of the kafka broker, separated by commas", field: func(c *Config) interface{} { return &c.Broker.Brokers }},
+	{name: "kafka-group", usage: "kafka consumer group or nats durable consumer, its members share the topic", field: func(c *Config) interface{} { return &c.Broker.Group }},
+	{name: "kafka-rebalance-timeout", usage: "how long the kafka group waits for its members to rejoin when rebalancing", field: func(c *Config) interface{} { return &c.Broker.RebalanceTimeout }},
+	{name: "kafka-start-offset", usage: "where a new kafka group or nats durable consumer starts consuming (earliest or latest)", field: func(c *Config) interface{} { return &c.Broker.StartOffset }},
+	{name: "broker-dir", usage: "directory of the filequeue broker queues", field: func(c *Config) interface{} { return &c.Broker.Dir }},
+	{name: "ingest-syslog-addr", usage: "UDP address the ingest broker receives syslog on (empty disables it)", field: func(c *Config) interface{} { return &c.Broker.SyslogAddr }},
+	{name: "ingest-http-addr", usage: "address the ingest broker serves POST /ingest on (empty disables it)", field: func(c *Config) interface{} { return &c.Broker.HttpAddr }},
+	{name: "ingest-buffer", usage: "log entries buffered by the ingest broker, more are dropped", field: func(c *Config) interface{} { return &c.Broker.Buffer }},
+	{name: "replay-from", usage: "RFC 3339 time a new nats durable consumer starts consuming from", field: func(c *Config) interface{} { return &c.Broker.ReplayFrom }},
+	{name: "replay-speed", usage: "replay log files at the pace of their timestamps this many times faster (0 is as fast as possible)", field: func(c *Config) interface{} { return &c.Broker.Speed }},
+	{name: "parser-url", usage: "url of the parser service", field: func(c *Config) interface{} { return &c.Services.ParserUrl }},
+	{name: "providers-url", usage: "url of the find_providers service", field: func(c *Config) interface{} { return &c.Services.ProvidersUrl }},
+	{name: "port", usage: "port of the find_providers service", field: func(c *Config) interface{} { return &c.Services.Port }},
+	{name: "service-timeout", usage: "timeout of each request to the services", field: func(c *Config) interface{} { return &c.Services.Client.Timeout }},
+	{name: "service-retries", usage: "retries of failed idempotent requests to the services", field: func(c *Config) interface{} { return &c.Services.Client.Retries }},
+	{name: "service-backoff-base", usage: "base backoff between retries", field: func(c *Config) interface{} { return &c.Services.Client.BackoffBase }},
+	{name: "service-backoff-max", usage: "maximum backoff between retries", field: func(c *Config) interface{} { return &c.Services.Client.BackoffMax }},
+	{name: "breaker-threshold", usage: "consecutive failures opening the circuit breaker of a service, 0 disables it", field: func(c *Config) interface{} { return &c.Services.Client.BreakerThreshold }},
+	{name: "breaker-cooldown", usage: "how long the circuit breaker of a service stays open", field: func(c *Config) interface{} { return &c.Services.Client.BreakerCooldown }},
+	{name: "lookup-timeout", usage: "timeout of each provider lookup", field: func(c *Config) interface{} { return &c.Services.LookupTimeout }},
+	{name: "concurrency", shorthand: "c", usage: "how many provider lookups to run in parallel", field: func(c *Config) interface{} { return &c.Controller.Concurrency }},
+	{name: "parse-workers", usage: "how many log entries to parse in parallel", field: func(c *Config) interface{} { return &c.Controller.ParseWorkers }},
+	{name: "parse-queue", usage: "how many log entries to queue for parsing before pausing consumption", field: func(c *Config) interface{} { return &c.Controller.ParseQueue }},
+	{name: "write-workers", usage: "how many database writes to run in parallel", field: func(c *Config) interface{} { return &c.Controller.WriteWorkers }},
+	{name: "write-queue", usage: "how many database writes to queue before pausing parsing", field: func(c *Config) interface{} { return &c.Controller.WriteQueue }},
+	{name: "lookup-queue", usage: "how many provider lookups to schedule before dropping the least popular ones", field: func(c *Config) interface{} { return &c.Controller.LookupQueue }},
+	{name: "popularity-window", usage: "how long the requests of a cid count towards its popularity", field: func(c *Config) interface{} { return &c.Controller.PopularityWindow }},
+	{name: "long-tail-threshold", usage: "cids requested at most this many times over the popularity window are the long tail", field: func(c *Config) interface{} { return &c.Controller.LongTailThreshold }},
+	{name: "long-tail-share", usage: "share of the lookups reserved for the long tail (0 to 1)", field: func(c *Config) interface{} { return &c.Controller.LongTailShare }},
+	{name: "dont-find-providers", shorthand: "d", usage: "Don't find providers", field: func(c *Config) interface{} { return &c.Controller.DontFindProviders }},
+	{name: "parser", usage: "parse log entries with the parser service (service) or in the controller (native)", field: func(c *Config) interface{} { return &c.Controller.Parser }},
+	{name: "request-id-fields", usage: "fields of the log entries fingerprinted into request ids", field: func(c *Config) interface{} { return &c.Controller.RequestIdFields }},
+	{name: "request-id-encoding", usage: "encoding of request ids (hex or base32)", field: func(c *Config) interface{} { return &c.Controller.RequestIdEncoding }},
+	{name: "cache-size", usage: "how many looked up cids to remember", field: func(c *Config) interface{} { return &c.Controller.CacheSize }},
+	{name: "cache-ttl", usage: "how long to wait before looking up the providers of a cid again", field: func(c *Config) interface{} { return &c.Controller.CacheTTL }},
+	{name: "negative-cache-ttl", usage: "how long to wait before looking up again a cid without providers", field: func(c *Config) interface{} { return &c.Controller.NegativeCacheTTL }},
+	{name: "cache-warm", usage: "load the recently looked up cids from the database on startup", field: func(c *Config) interface{} { return &c.Controller.CacheWarm }},
+	{name: "geo-city-db", usage: "path of the GeoLite2 City database", field: func(c *Config) interface{} { return &c.Geo.CityDB }},
+	{name: "geo-asn-db", usage: "path of the GeoLite2 ASN database", field: func(c *Config) interface{} { return &c.Geo.ASNDB }},
+	{name: "geo-reload-interval", usage: "how often to check the geolocation databases for updates (0 disables it)", field: func(c *Config) interface{} { return &c.Geo.ReloadInterval }},
+	{name: "shutdown-timeout", usage: "how long to wait for in-flight lookups and writes on shutdown", field: func(c *Config) interface{} { return &c.Controller.ShutdownTimeout }},
+	{name: "writer-topic", usage: "broker topic of the find_providers logs consumed by the writer", field: func(c *Config) interface{} { return &c.Writer.Topic }},
+	{name: "dead-letter", usage: "where to send log entries that fail to be processed (none, table or queue)", field: func(c *Config) interface{} { return &c.DeadLetter.Type }},
+	{name: "dead-letter-topic", usage: "broker queue of failed log entries, for the queue dead letter", field: func(c *Config) interface{} { return &c.DeadLetter.Topic }},
+	{name: "claims", usage: "how controllers share lookups: local (a single controller) or postgres (the lookup_claims table)", field: func(c *Config) interface{} { return &c.Claims.Type }},
+	{name: "claim-lease", usage: "how long a claim on a cid holds while it is looked up", field: func(c *Config) interface{} { return &c.Claims.Lease }},
+	{name: "claim-owner", usage: "name of the controller in its claims (defaults to the host name and process id)", field: func(c *Config) interface{} { return &c.Claims.Owner }},
+	{name: "ship-paths", usage: "nginx access logs shipped to the broker, separated by commas", field: func(c *Config) interface{} { return &c.Shipper.Paths }},
+	{name: "ship-state-file", usage: "file keeping the offsets of the shipped logs", field: func(c *Config) interface{} { return &c.Shipper.StateFile }},
+	{name: "ship-from-start", usage: "ship the logs without a saved offset from their start instead of their end", field: func(c *Config) interface{} { return &c.Shipper.FromStart }},
+	{name: "ship-filter", usage: "only ship the GET requests of a cid", field: func(c *Config) interface{} { return &c.Shipper.Filter }},
+	{name: "ship-batch-size", usage: "log lines published at once", field: func(c *Config) interface{} { return &c.Shipper.BatchSize }},
+	{name: "ship-batch-interval", usage: "how long log lines wait for a batch at most", field: func(c *Config) interface{} { return &c.Shipper.BatchInterval }},
+	{name: "ship-poll-interval", usage: "how often the logs are checked for new lines", field: func(c *Config) interface{} { return &c.Shipper.PollInterval }},
+}
+
+// RegisterFlags registers on fs the flags of every configuration option, using defaults for their default values
+func RegisterFlags(fs *pflag.FlagSet, defaults Config) {
+	fs.String(configFlag, "", fmt.Sprintf("configuration file (.yaml, .yml or .toml), also read from %v%v", EnvPrefix, envName(configFlag)))
+	for _, o := range options {
+		usage := fmt.Sprintf("%v (env %v%v)", o.usage, EnvPrefix, envName(o.name))
+		switch p := o.field(&defaults).(type) {
+		case *string:
+			fs.StringP(o.name, o.shorthand, *p, usage)
+		case *int:
+			fs.IntP(o.name, o.shorthand, *p, usage)
+		case *bool:
+			fs.BoolP(o.name, o.shorthand, *p, usage)
+		case *time.Duration:
+			fs.DurationP(o.name, o.shorthand, *p, usage)
+		case *float64:
+			fs.Float64P(o.name, o.shorthand, *p, usage)
+		case *[]string:
+			fs.StringSliceP(o.name, o.shorthand, *p, usage)
+		default:
+			panic(fmt.Sprintf("option %v has unsupported type %T", o.name, p))
+		}
+	}
+}
+
+// Load fills c from the configuration file, the environment and the flags set in fs, then validates it with validate,
+// the Validate method of the binary, so a binary does not reject the settings it never reads
+// The precedence, from lowest to highest, is: the values already in c, the file, the environment and the flags
+func Load(c *Config, fs *pflag.FlagSet, validate func(Config) error) error {
+	path := os.Getenv(EnvPrefix + envName(configFlag))
+	if f := fs.Lookup(configFlag); f != nil && f.Changed {
+		path = f.Value.String()
+	}
+	if path != "" {
+		if err := loadFile(c, path); err != nil {
+			return err
+		}
+	}
+
+	for _, o := range options {
+		if v, ok := os.LookupEnv(EnvPrefix + envName(o.name)); ok {
+			if err := set(o.field(c), v); err != nil {
+				return fmt.Errorf("%v%v: %v", EnvPrefix, envName(o.name), err)
+			}
+		}
+	}
+
+	for _, o := range options {
+		if f := fs.Lookup(o.name); f != nil && f.Changed {
+			if p, ok := o.field(c).(*[]string); ok {
+				// the string of a slice flag is bracketed
+				*p, _ = fs.GetStringSlice(o.name)
+				continue
+			}
+			if err := set(o.field(c), f.Value.String()); err != nil {
+				return fmt.Errorf("--%v: %v", o.name, err)
+			}
+		}
+	}
+
+	return validate(*c)
+}
+
+// loadFile decodes the configuration file at path into c, choosing the format from its extension
+func loadFile(c *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, c)
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(data), c)
+		if err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown keys %v", md.Undecoded())
+		}
+	default:
+		return fmt.Errorf("config file %v: unknown format, expected .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("config file %v: %v", path, err)
+	}
+	return nil
+}
+
+// set parses v into the field pointed by p
+func set(p interface{}, v string) error {
+	switch p := p.(type) {
+	case *string:
+		*p = v
+	case *int:
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*p = i
+	case *bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*p = b
+	case *time.Duration:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*p = d
+	case *float64:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return err
+		}
+		*p = f
+	case *[]string:
+		// comma separated
+		*p = nil
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				*p = append(*p, s)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported type %T", p)
+	}
+	return nil
+}
+
+// envName converts a flag name into the suffix of its environment variable
+func envName(flag string) string {
+	return strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// noValidation accepts any configuration
+func noValidation(Config) error { return nil }
+
+// load loads the configuration as a binary started with args does
+func load(t *testing.T, args ...string) (Config, error) {
+	t.Helper()
+	c := Default()
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	RegisterFlags(fs, c)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	err := Load(&c, fs, noValidation)
+	return c, err
+}
+
+// writeFile writes a configuration file named name and returns its path
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPrecedence(t *testing.T) {
+	file := writeFile(t, "config.yaml", "controller:\n  concurrency: 10\n  cache_size: 5\n")
+	for _, c := range []struct {
+		name        string
+		env         map[string]string
+		args        []string
+		concurrency int
+		// fromFile tells if the file is loaded
+		fromFile bool
+	}{
+		{name: "default", concurrency: Default().Controller.Concurrency},
+		{name: "file", env: map[string]string{"IPFS_LOC_CONFIG": file}, concurrency: 10, fromFile: true},
+		{name: "file flag", args: []string{"--config", file}, concurrency: 10, fromFile: true},
+		{name: "env over file", env: map[string]string{"IPFS_LOC_CONFIG": file, "IPFS_LOC_CONCURRENCY": "20"}, concurrency: 20, fromFile: true},
+		{
+			name:        "flag over env",
+			env:         map[string]string{"IPFS_LOC_CONFIG": file, "IPFS_LOC_CONCURRENCY": "20"},
+			args:        []string{"--concurrency", "30"},
+			concurrency: 30,
+			fromFile:    true,
+		},
+		{name: "shorthand flag over file", args: []string{"--config", file, "-c", "40"}, concurrency: 40, fromFile: true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			for k, v := range c.env {
+				t.Setenv(k, v)
+			}
+			conf, err := load(t, c.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conf.Controller.Concurrency != c.concurrency {
+				t.Fatalf("got concurrency %v, expected %v", conf.Controller.Concurrency, c.concurrency)
+			}
+			// the settings set nowhere else keep the value of the file, or the default
+			cacheSize := Default().Controller.CacheSize
+			if c.fromFile {
+				cacheSize = 5
+			}
+			if conf.Controller.CacheSize != cacheSize {
+				t.Fatalf("got cache size %v, expected %v", conf.Controller.CacheSize, cacheSize)
+			}
+		})
+	}
+}
+
+func TestFileFormats(t *testing.T) {
+	for _, c := range []struct {
+		name, file, content string
+		// err is part of the error expected, if any
+		err string
+	}{
+		{name: "yaml", file: "config.yaml", content: "controller:\n  cache_ttl: 2h\n"},
+		{name: "yml", file: "config.yml", content: "controller:\n  cache_ttl: 2h\n"},
+		{name: "toml", file: "config.toml", content: "[controller]\ncache_ttl = \"2h\"\n"},
+		{name: "yaml unknown key", file: "config.yaml", content: "controller:\n  cache_tll: 2h\n", err: "cache_tll"},
+		{name: "yaml unknown section", file: "config.yaml", content: "controler:\n  cache_ttl: 2h\n", err: "controler"},
+		{name: "toml unknown key", file: "config.toml", content: "[controller]\ncache_tll = \"2h\"\n", err: "cache_tll"},
+		{name: "unknown format", file: "config.json", content: "{}", err: "unknown format"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			conf, err := load(t, "--config", writeFile(t, c.file, c.content))
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("got error %v, expected it to mention %q", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conf.Controller.CacheTTL != 2*time.Hour {
+				t.Fatalf("got cache ttl %v, expected 2h", conf.Controller.CacheTTL)
+			}
+		})
+	}
+}
+
+func TestEnv(t *testing.T) {
+	for _, c := range []struct {
+		name, env, value string
+		// field returns the field set by the environment variable
+		field    func(c *Config) interface{}
+		expected interface{}
+		// err is part of the error expected, if any
+		err string
+	}{
+		{name: "duration", env: "IPFS_LOC_CACHE_TTL", value: "90m", field: func(c *Config) interface{} { return c.Controller.CacheTTL }, expected: 90 * time.Minute},
+		{name: "duration without unit", env: "IPFS_LOC_CACHE_TTL", value: "90", err: "IPFS_LOC_CACHE_TTL"},
+		{name: "nested duration", env: "IPFS_LOC_POSTGRES_CONN_MAX_LIFETIME", value: "1h30m", field: func(c *Config) interface{} { return c.Database.Postgres.ConnMaxLifetime }, expected: 90 * time.Minute},
+		{name: "int", env: "IPFS_LOC_POSTGRES_PORT", value: "6432", field: func(c *Config) interface{} { return c.Database.Postgres.Port }, expected: 6432},
+		{name: "invalid int", env: "IPFS_LOC_POSTGRES_PORT", value: "five", err: "IPFS_LOC_POSTGRES_PORT"},
+		{name: "bool", env: "IPFS_LOC_CACHE_WARM", value: "false", field: func(c *Config) interface{} { return c.Controller.CacheWarm }, expected: false},
+		{name: "float", env: "IPFS_LOC_LONG_TAIL_SHARE", value: "0.5", field: func(c *Config) interface{} { return c.Controller.LongTailShare }, expected: 0.5},
+		{name: "list", env: "IPFS_LOC_KAFKA_BROKERS", value: "a:9092, b:9092,", field: func(c *Config) interface{} { return c.Broker.Brokers }, expected: []string{"a:9092", "b:9092"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			t.Setenv(c.env, c.value)
+			conf, err := load(t)
+			if c.err != "" {
+				if err == nil || !strings.Contains(err.Error(), c.err) {
+					t.Fatalf("got error %v, expected it to mention %q", err, c.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v := c.field(&conf); !reflect.DeepEqual(v, c.expected) {
+				t.Fatalf("got %#v, expected %#v", v, c.expected)
+			}
+		})
+	}
+}
+
+func TestListFlag(t *testing.T) {
+	t.Setenv("IPFS_LOC_KAFKA_BROKERS", "a:9092")
+	conf, err := load(t, "--kafka-brokers", "b:9092,c:9092")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conf.Broker.Brokers, []string{"b:9092", "c:9092"}) {
+		t.Fatalf("got brokers %v, expected those of the flag", conf.Broker.Brokers)
+	}
+}
+
+func TestLoadValidates(t *testing.T) {
+	t.Setenv("IPFS_LOC_CONCURRENCY", "0")
+	c := Default()
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	RegisterFlags(fs, c)
+	if err := Load(&c, fs, Config.ValidateController); err == nil || !strings.Contains(err.Error(), "controller.concurrency") {
+		t.Fatalf("got error %v, expected the controller to reject its concurrency", err)
+	}
+	c = Default()
+	if err := Load(&c, fs, Config.ValidateService); err != nil {
+		t.Fatalf("got error %v, expected the service to ignore the settings of the controller", err)
+	}
+}
@@ -0,0 +1,360 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"find_providers/pkg/model"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrWriterClosed is returned when adding to a closed BatchWriter
+var ErrWriterClosed = errors.New("batch writer is closed")
+
+// BatchConf tunes a BatchWriter
+type BatchConf struct {
+	// Size is how many rows are buffered before they are flushed
+	Size int `yaml:"size" toml:"size"`
+	// Interval is how long rows are buffered for at most before they are flushed
+	Interval time.Duration `yaml:"interval" toml:"interval"`
+	// MaxPending is how many entries and provider lookups wait for the buffer before adding blocks
+	MaxPending int `yaml:"max_pending" toml:"max_pending"`
+}
+
+// BatchWriter buffers entries and providers and writes them to the database in batches
+// On postgres a batch is copied into staging tables and merged into the requests and providers tables with the
+// same conflict handling as the row by row writes, if it fails its rows are written one by one so only the bad
+// ones fail. Other databases are always written row by row
+type BatchWriter struct {
+	// accessed atomically, kept first for 64-bit alignment
+	flushes     int64
+	rows        int64
+	failedRows  int64
+	fallbacks   int64
+	lastFlushNs int64
+
+	db    *DB
+	conf  BatchConf
+	items chan batchItem
+	done  chan struct{}
+
+	closeLock sync.RWMutex
+	closed    bool
+}
+
+// BatchStats are the counters of a BatchWriter
+type BatchStats struct {
+	// Flushes and Rows count the batches and rows written, FailedRows the rows that could not be written
+	Flushes    int64
+	Rows       int64
+	FailedRows int64
+	// Fallbacks counts the batches that failed and were written row by row
+	Fallbacks int64
+	Pending   int
+	LastFlush time.Duration
+}
+
+// batchItem is an entry, or the providers found by a lookup, waiting to be written
+type batchItem struct {
+	entry    *model.EntryStruct
+	reqId    string
+	found    time.Time
+	requests time.Time
+	ans      *model.JsonAnswer
+	done     func(error)
+}
+
+// rows returns how many table rows the item is written as
+func (it batchItem) rows() int {
+	if it.entry != nil {
+		return 1
+	}
+	n := 0
+	for _, prov := range it.ans.Providers {
+		n += len(prov.Locations)
+	}
+	return n
+}
+
+// validate checks that the rows of the item can be written
+func (it batchItem) validate() error {
+	if it.entry != nil {
+		return validateEntry(*it.entry, it.reqId)
+	}
+	return validateProviders(*it.ans)
+}
+
+// NewBatchWriter creates a batch writer and starts flushing
+func (db *DB) NewBatchWriter(conf BatchConf) *BatchWriter {
+	w := &BatchWriter{
+		db:    db,
+		conf:  conf,
+		items: make(chan batchItem, conf.MaxPending),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// AddEntry queues the entry to be written, as WriteEntryToDB does, waiting while MaxPending items are queued
+// done is called with the outcome of the write once it is flushed, it must not add to the writer
+func (w *BatchWriter) AddEntry(ctx context.Context, e model.EntryStruct, reqId string, done func(error)) error {
+	return w.add(ctx, batchItem{entry: &e, reqId: reqId, done: done})
+}
+
+// AddProviders queues the providers to be written, as WriteProvidersToDB does, waiting while MaxPending items are queued
+// done is called with the outcome of the write once it is flushed, it must not add to the writer
+func (w *BatchWriter) AddProviders(ctx context.Context, t time.Time, n time.Time, ans model.JsonAnswer, done func(error)) error {
+	return w.add(ctx, batchItem{requests: t, found: n, ans: &ans, done: done})
+}
+
+// add queues an item, returns ctx.Err() if ctx is done before there is room or ErrWriterClosed if the writer is closed
+func (w *BatchWriter) add(ctx context.Context, it batchItem) error {
+	w.closeLock.RLock()
+	defer w.closeLock.RUnlock()
+	if w.closed {
+		return ErrWriterClosed
+	}
+	select {
+	case w.items <- it:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting items, what is queued is flushed before the writer stops
+func (w *BatchWriter) Close() {
+	w.closeLock.Lock()
+	defer w.closeLock.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.items)
+	}
+}
+
+// Wait waits until the writer is closed and everything queued is flushed, or until ctx is done
+// Returns whether everything was flushed
+func (w *BatchWriter) Wait(ctx context.Context) bool {
+	select {
+	case <-w.done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Stats returns the current counters of the writer
+func (w *BatchWriter) Stats() BatchStats {
+	return BatchStats{
+		Flushes:    atomic.LoadInt64(&w.flushes),
+		Rows:       atomic.LoadInt64(&w.rows),
+		FailedRows: atomic.LoadInt64(&w.failedRows),
+		Fallbacks:  atomic.LoadInt64(&w.fallbacks),
+		Pending:    len(w.items),
+		LastFlush:  time.Duration(atomic.LoadInt64(&w.lastFlushNs)),
+	}
+}
+
+// run buffers the queued items and flushes them when Size rows are buffered or every Interval
+func (w *BatchWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.conf.Interval)
+	defer ticker.Stop()
+
+	batch := make([]batchItem, 0, w.conf.Size)
+	rows := 0
+	for {
+		select {
+		case it, ok := <-w.items:
+			if !ok {
+				w.flush(batch, rows)
+				return
+			}
+			batch = append(batch, it)
+			rows += it.rows()
+			if rows < w.conf.Size {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		w.flush(batch, rows)
+		batch = batch[:0]
+		rows = 0
+	}
+}
+
+// flush writes the batch and reports the outcome of each item, the invalid items fail without being written
+func (w *BatchWriter) flush(batch []batchItem, rows int) {
+	if len(batch) == 0 {
+		return
+	}
+	start := time.Now()
+	invalid := make([]error, len(batch))
+	valid := make([]batchItem, 0, len(batch))
+	for i, it := range batch {
+		invalid[i] = it.validate()
+		if invalid[i] == nil {
+			valid = append(valid, it)
+		}
+	}
+	var errs []error
+	if w.db.dbToUse == "postgres" && len(valid) > 0 {
+		err := w.db.copyBatch(valid)
+		if err == nil {
+			errs = make([]error, len(valid))
+		} else {
+			log.Warning("Error flushing batch of ", rows, " rows, writing them one by one: ", err)
+			atomic.AddInt64(&w.fallbacks, 1)
+		}
+	}
+	if errs == nil {
+		errs = w.db.writeOneByOne(valid)
+	}
+	took := time.Since(start)
+
+	for i, it := range batch {
+		err := invalid[i]
+		if err == nil {
+			err, errs = errs[0], errs[1:]
+		}
+		if err != nil {
+			atomic.AddInt64(&w.failedRows, int64(it.rows()))
+		}
+		if it.done != nil {
+			it.done(err)
+		}
+	}
+	atomic.AddInt64(&w.flushes, 1)
+	atomic.AddInt64(&w.rows, int64(rows))
+	atomic.StoreInt64(&w.lastFlushNs, int64(took))
+	log.Debug("Flushed batch of ", len(batch), " items, ", rows, " rows in ", took)
+}
+
+// writeOneByOne writes the items of a batch with the row by row writes, returning the error of each item
+func (db *DB) writeOneByOne(batch []batchItem) []error {
+	errs := make([]error, len(batch))
+	for i, it := range batch {
+		if it.entry != nil {
+			errs[i] = db.WriteEntryToDB(*it.entry, it.reqId)
+		} else {
+			errs[i] = db.WriteProvidersToDB(it.requests, it.found, *it.ans)
+		}
+	}
+	return errs
+}
+
+// copyBatch copies the rows of a batch into staging tables and merges them into the requests and providers tables
+// within a transaction, so either the whole batch is written or nothing is
+func (db *DB) copyBatch(batch []batchItem) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+			CREATE TEMP TABLE requests_staging (LIKE public.requests) ON COMMIT DROP;
+			CREATE TEMP TABLE providers_staging (LIKE public.providers, seq int) ON COMMIT DROP
+			`); err != nil {
+		return err
+	}
+
+	requests, err := tx.Prepare(pq.CopyIn("requests_staging", requestColumns...))
+	if err != nil {
+		return err
+	}
+	for _, it := range batch {
+		if it.entry == nil {
+			continue
+		}
+		if _, err := requests.Exec(entryRow(*it.entry, it.reqId)...); err != nil {
+			return fmt.Errorf("copying requests: %v", err)
+		}
+	}
+	if _, err := requests.Exec(); err != nil {
+		return fmt.Errorf("copying requests: %v", err)
+	}
+	if err := requests.Close(); err != nil {
+		return err
+	}
+
+	// seq keeps the order of the rows, later rows update earlier ones as consecutive upserts would
+	providers, err := tx.Prepare(pq.CopyIn("providers_staging", append(providerColumns, "seq")...))
+	if err != nil {
+		return err
+	}
+	seq := 0
+	for _, it := range batch {
+		if it.ans == nil {
+			continue
+		}
+		for _, prov := range it.ans.Providers {
+			for _, locs := range prov.Locations {
+				if _, err := providers.Exec(append(providerRow(it.found, *it.ans, prov, locs), seq)...); err != nil {
+					return fmt.Errorf("copying providers: %v", err)
+				}
+				seq++
+			}
+		}
+	}
+	if _, err := providers.Exec(); err != nil {
+		return fmt.Errorf("copying providers: %v", err)
+	}
+	if err := providers.Close(); err != nil {
+		return err
+	}
+
+	columns := strings.Join(requestColumns, ", ")
+	if _, err := tx.Exec(`
+			INSERT INTO public.requests (` + columns + `)
+			SELECT ` + columns + ` FROM requests_staging
+			ON CONFLICT ON CONSTRAINT requests_pkey DO
+			NOTHING
+			`); err != nil {
+		return fmt.Errorf("merging requests: %v", err)
+	}
+
+	// rows of the same provider are folded into one, keeping the last value of every column that has one,
+	// which is what upserting them one after the other leaves
+	if _, err := tx.Exec(`
+			INSERT INTO public.providers
+			(cid, continent, country, region, lat, long, asn, aso,
+			request_time, peerID, found_at, updated_at)
+			SELECT cid,
+			    (array_agg(continent ORDER BY seq DESC) FILTER (WHERE continent IS NOT NULL))[1],
+			    (array_agg(country ORDER BY seq DESC) FILTER (WHERE country IS NOT NULL))[1],
+			    (array_agg(region ORDER BY seq DESC) FILTER (WHERE region IS NOT NULL))[1],
+			    (array_agg(lat ORDER BY seq DESC) FILTER (WHERE lat IS NOT NULL))[1],
+			    (array_agg(long ORDER BY seq DESC) FILTER (WHERE long IS NOT NULL))[1],
+			    (array_agg(asn ORDER BY seq DESC) FILTER (WHERE asn IS NOT NULL))[1],
+			    (array_agg(aso ORDER BY seq DESC) FILTER (WHERE aso IS NOT NULL))[1],
+			    (array_agg(request_time ORDER BY seq))[1],
+			    peerID,
+			    (array_agg(found_at ORDER BY seq))[1],
+			    (array_agg(updated_at ORDER BY seq DESC))[1]
+			FROM providers_staging
+			GROUP BY cid, peerID
+			ON CONFLICT ON CONSTRAINT providers_pkey DO
+			UPDATE SET continent=COALESCE(NULLIF(EXCLUDED.continent, ''), providers.continent),
+			    country=COALESCE(NULLIF(EXCLUDED.country, ''), providers.country),
+			    region=COALESCE(NULLIF(EXCLUDED.region, ''), providers.region),
+			    lat=COALESCE(EXCLUDED.lat, providers.lat),
+			    long=COALESCE(EXCLUDED.long, providers.long),
+			    asn=COALESCE(EXCLUDED.asn, providers.asn),
+			    aso=COALESCE(NULLIF(EXCLUDED.aso, ''), providers.aso),
+			    updated_at = EXCLUDED.updated_at
+			`); err != nil {
+		return fmt.Errorf("merging providers: %v", err)
+	}
+	return tx.Commit()
+}
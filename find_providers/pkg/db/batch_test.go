@@ -0,0 +1,236 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"find_providers/pkg/model"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// postgresDSNEnv holds the connection string of a scratch postgres database the integration tests migrate and
+// write to, the rows they write are deleted once they are done
+const postgresDSNEnv = "POSTGRES_DSN"
+
+// postgresTestDB connects to the database of postgresDSNEnv and migrates it, skipping the test if it is not set
+// Returns the database and a prefix of the cids the test writes, unique to it
+func postgresTestDB(t *testing.T) (*DB, string) {
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skip(postgresDSNEnv, "is not set, skipping the postgres integration test")
+	}
+	sqlDB, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &DB{dbToUse: "postgres", db: sqlDB}
+	if _, err := db.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	prefix := fmt.Sprintf("test-%d-", time.Now().UnixNano())
+	t.Cleanup(func() {
+		for _, table := range []string{"requests", "providers"} {
+			if _, err := sqlDB.Exec(`DELETE FROM public.`+table+` WHERE cid LIKE $1`, prefix+"%"); err != nil {
+				t.Error(err)
+			}
+		}
+		sqlDB.Close()
+	})
+	return db, prefix
+}
+
+// testEntry returns an entry of the cid
+func testEntry(cid, userAgent string) model.EntryStruct {
+	return model.EntryStruct{
+		Time:                 time.Date(2022, 3, 21, 0, 0, 58, 0, time.UTC),
+		Ip:                   "199.83.232.50",
+		Cid:                  cid,
+		Op:                   "GET",
+		Status:               "200",
+		BodyBytes:            "50470",
+		RequestLength:        "120",
+		RequestTime:          "12.823",
+		UpstreamResponseTime: []string{"0.500", "12.320"},
+		UpstreamHeaderTime:   []string{"0.400", "12.320"},
+		Cache:                "MISS",
+		HttpUserAgent:        userAgent,
+		HttpHost:             "ipfs.io",
+		Scheme:               "https",
+	}
+}
+
+// outcomes records the outcome of the items added to a batch writer, by name
+type outcomes struct {
+	lock sync.Mutex
+	errs map[string][]error
+}
+
+// done returns the done callback of the named item
+func (o *outcomes) done(name string) func(error) {
+	return func(err error) {
+		o.lock.Lock()
+		defer o.lock.Unlock()
+		o.errs[name] = append(o.errs[name], err)
+	}
+}
+
+// check checks that every named item was done once, failed if it is in failed and succeeded otherwise
+func (o *outcomes) check(t *testing.T, names []string, failed ...string) {
+	t.Helper()
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for _, name := range names {
+		errs := o.errs[name]
+		if len(errs) != 1 {
+			t.Errorf("%v was done %v times, expected once", name, len(errs))
+			continue
+		}
+		shouldFail := false
+		for _, f := range failed {
+			shouldFail = shouldFail || f == name
+		}
+		if shouldFail && errs[0] == nil {
+			t.Errorf("%v was written, expected it to fail", name)
+		}
+		if !shouldFail && errs[0] != nil {
+			t.Errorf("%v failed: %v", name, errs[0])
+		}
+	}
+}
+
+// flushAll closes the writer and waits for everything queued to be flushed
+func flushAll(t *testing.T, w *BatchWriter) {
+	t.Helper()
+	w.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if !w.Wait(ctx) {
+		t.Fatal("the batch writer did not flush in time")
+	}
+}
+
+// count counts the rows of the table matching the condition
+func count(t *testing.T, db *DB, table, condition string, args ...interface{}) int {
+	t.Helper()
+	var n int
+	if err := db.db.QueryRow(`SELECT count(*) FROM public.`+table+` WHERE `+condition, args...).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestBatchWriterCopiesBatches(t *testing.T) {
+	db, prefix := postgresTestDB(t)
+	w := db.NewBatchWriter(BatchConf{Size: 1000, Interval: time.Hour, MaxPending: 100})
+	o := &outcomes{errs: map[string][]error{}}
+	ctx := context.Background()
+	cid := prefix + "cid"
+	found := time.Date(2022, 3, 21, 0, 1, 0, 0, time.UTC)
+
+	adds := []struct {
+		name string
+		add  func() error
+	}{
+		{"entry", func() error { return w.AddEntry(ctx, testEntry(cid, "Mozilla/5.0"), prefix+"a", o.done("entry")) }},
+		// the same request again is not written twice
+		{"duplicate", func() error { return w.AddEntry(ctx, testEntry(cid, "curl/7.68.0"), prefix+"a", o.done("duplicate")) }},
+		// postgres refuses invalid utf8, the entry fails alone
+		{"invalid utf8", func() error {
+			return w.AddEntry(ctx, testEntry(cid, "Mozilla/5.0 \xff"), prefix+"b", o.done("invalid utf8"))
+		}},
+		{"other entry", func() error { return w.AddEntry(ctx, testEntry(cid, "Mozilla/5.0"), prefix+"c", o.done("other entry")) }},
+		{"providers", func() error {
+			return w.AddProviders(ctx, found, found, model.JsonAnswer{Cid: cid, Dur: time.Second, Providers: []model.Provider{{
+				PeerId:    "QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN",
+				Locations: []model.Location{{Continent: "EU", Country: "PT"}, {Continent: "NA", Country: "US"}},
+			}}}, o.done("providers"))
+		}},
+	}
+	var names []string
+	for _, a := range adds {
+		names = append(names, a.name)
+		if err := a.add(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(t, w)
+
+	o.check(t, names, "invalid utf8")
+	if st := w.Stats(); st.Flushes != 1 || st.Fallbacks != 0 || st.FailedRows != 1 {
+		t.Fatalf("got %+v, expected a single batch copied with a row failing", st)
+	}
+	if n := count(t, db, "requests", "req_id = $1", prefix+"a"); n != 1 {
+		t.Fatalf("got %v rows of the duplicate request, expected 1", n)
+	}
+	if n := count(t, db, "requests", "cid = $1", cid); n != 2 {
+		t.Fatalf("got %v requests, expected 2", n)
+	}
+	// the locations of a provider are folded into its row, keeping the last one
+	if n := count(t, db, "providers", "cid = $1 AND continent = 'NA' AND country = 'US'", cid); n != 1 {
+		t.Fatalf("got %v providers rows with the last location, expected 1", n)
+	}
+}
+
+func TestBatchWriterFallsBackToRowByRow(t *testing.T) {
+	db, prefix := postgresTestDB(t)
+	w := db.NewBatchWriter(BatchConf{Size: 1000, Interval: time.Hour, MaxPending: 100})
+	o := &outcomes{errs: map[string][]error{}}
+	ctx := context.Background()
+	cid := prefix + "cid"
+
+	// valid utf8, but postgres refuses the NUL character in text, failing the copy of the whole batch
+	if err := w.AddEntry(ctx, testEntry(cid, "Mozilla/5.0\x00"), prefix+"nul", o.done("nul")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := w.AddEntry(ctx, testEntry(cid, "Mozilla/5.0"), prefix+name, o.done(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// an earlier version of the batch writer wrote the request already
+	if err := db.WriteEntryToDB(testEntry(cid, "Mozilla/5.0"), prefix+"b"); err != nil {
+		t.Fatal(err)
+	}
+	flushAll(t, w)
+
+	o.check(t, []string{"nul", "a", "b"}, "nul")
+	if st := w.Stats(); st.Flushes != 1 || st.Fallbacks != 1 || st.FailedRows != 1 {
+		t.Fatalf("got %+v, expected a single batch written row by row with a row failing", st)
+	}
+	if n := count(t, db, "requests", "cid = $1", cid); n != 2 {
+		t.Fatalf("got %v requests, expected the 2 valid ones", n)
+	}
+	if n := count(t, db, "requests", "req_id = $1", prefix+"nul"); n != 0 {
+		t.Fatalf("got %v rows of the failed request", n)
+	}
+}
+
+func TestBatchWriterFlushesEverySize(t *testing.T) {
+	db, prefix := postgresTestDB(t)
+	w := db.NewBatchWriter(BatchConf{Size: 2, Interval: time.Hour, MaxPending: 100})
+	o := &outcomes{errs: map[string][]error{}}
+	var names []string
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprint(i)
+		names = append(names, name)
+		if err := w.AddEntry(context.Background(), testEntry(prefix+"cid", "Mozilla/5.0"), prefix+name, o.done(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(t, w)
+
+	o.check(t, names)
+	// 2 batches of 2 rows, then the last row once closed
+	if st := w.Stats(); st.Flushes != 3 || st.Rows != 5 {
+		t.Fatalf("got %+v, expected 3 batches", st)
+	}
+	if err := w.AddEntry(context.Background(), testEntry(prefix+"cid", "Mozilla/5.0"), prefix+"late", nil); err != ErrWriterClosed {
+		t.Fatalf("got %v, expected %v", err, ErrWriterClosed)
+	}
+	if n := count(t, db, "requests", "cid LIKE $1", prefix+"%"); n != 5 {
+		t.Fatalf("got %v requests, expected 5", n)
+	}
+}
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ClaimLookup claims the lookup of the cid for owner during lease, unless someone else holds a claim that has not
+// expired yet. Returns whether the cid was claimed and, if not, until when the current claim holds
+// Expiry is measured with the clock of the database, which all the controllers share
+func (db *DB) ClaimLookup(cid, owner string, lease time.Duration) (bool, time.Time, error) {
+	if db.dbToUse != "postgres" {
+		return false, time.Time{}, fmt.Errorf("lookup claims are not supported on %v", db.dbToUse)
+	}
+	var until time.Time
+	err := db.db.QueryRow(`
+			INSERT INTO public.lookup_claims AS c (cid, owner, expires_at)
+			VALUES ($1, $2, now() + make_interval(secs => $3))
+			ON CONFLICT (cid) DO
+			UPDATE SET owner = EXCLUDED.owner, expires_at = EXCLUDED.expires_at
+			WHERE c.expires_at < now()
+			RETURNING expires_at
+			`, cid, owner, lease.Seconds()).Scan(&until)
+	if err == nil {
+		return true, until, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, time.Time{}, err
+	}
+	// held by someone else
+	err = db.db.QueryRow(`SELECT expires_at FROM public.lookup_claims WHERE cid = $1`, cid).Scan(&until)
+	if errors.Is(err, sql.ErrNoRows) {
+		// released meanwhile, it can be claimed next time
+		return false, time.Now(), nil
+	}
+	return false, until, err
+}
+
+// HoldLookupClaim extends the claim of owner on the cid for hold, from now
+func (db *DB) HoldLookupClaim(cid, owner string, hold time.Duration) error {
+	_, err := db.db.Exec(`
+			UPDATE public.lookup_claims SET expires_at = now() + make_interval(secs => $3)
+			WHERE cid = $1 AND owner = $2
+			`, cid, owner, hold.Seconds())
+	return err
+}
+
+// ReleaseLookupClaim releases the claim of owner on the cid, so anyone can claim it again
+func (db *DB) ReleaseLookupClaim(cid, owner string) error {
+	_, err := db.db.Exec(`DELETE FROM public.lookup_claims WHERE cid = $1 AND owner = $2`, cid, owner)
+	return err
+}
+
+// PruneLookupClaims deletes the expired claims and returns how many were deleted
+func (db *DB) PruneLookupClaims() (int64, error) {
+	res, err := db.db.Exec(`DELETE FROM public.lookup_claims WHERE expires_at < now()`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
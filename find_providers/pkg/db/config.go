@@ -1,19 +1,39 @@
 package db
 
+import "time"
+
 type Config interface {
 }
 
 type PostgresConf struct {
-	Host     string
-	Port     int
-	User     string
-	Password string
-	DBname   string
+	Host     string `yaml:"host" toml:"host"`
+	Port     int    `yaml:"port" toml:"port"`
+	User     string `yaml:"user" toml:"user"`
+	Password string `yaml:"password" toml:"password"`
+	// PasswordFile holds the password instead of Password, it is read again on every new connection
+	PasswordFile string `yaml:"password_file" toml:"password_file"`
+	DBname       string `yaml:"dbname" toml:"dbname"`
+	// SSLMode is disable, allow, prefer, require, verify-ca or verify-full, as for libpq
+	SSLMode     string `yaml:"sslmode" toml:"sslmode"`
+	SSLRootCert string `yaml:"sslrootcert" toml:"sslrootcert"`
+	SSLCert     string `yaml:"sslcert" toml:"sslcert"`
+	SSLKey      string `yaml:"sslkey" toml:"sslkey"`
+	// MaxOpenConns bounds the connections to the database, 0 leaves them unbounded
+	MaxOpenConns int `yaml:"max_open_conns" toml:"max_open_conns"`
+	// MaxIdleConns is how many idle connections are kept for reuse
+	MaxIdleConns int `yaml:"max_idle_conns" toml:"max_idle_conns"`
+	// ConnMaxLifetime and ConnMaxIdleTime close connections this old or idle this long, 0 keeps them
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time" toml:"conn_max_idle_time"`
+	// StatementTimeout aborts the statements running longer, 0 lets them run
+	StatementTimeout time.Duration `yaml:"statement_timeout" toml:"statement_timeout"`
+	// Migrate applies the pending schema migrations at startup, otherwise the schema must already be up to date
+	Migrate bool `yaml:"migrate" toml:"migrate"`
 }
 
 type InfluxDBConf struct {
-	Org    string
-	Bucket string
-	DBUrl  string
-	Token  string
+	Org    string `yaml:"org" toml:"org"`
+	Bucket string `yaml:"bucket" toml:"bucket"`
+	DBUrl  string `yaml:"url" toml:"url"`
+	Token  string `yaml:"token" toml:"token"`
 }
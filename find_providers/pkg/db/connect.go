@@ -0,0 +1,106 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// SSLModes are the sslmode values of PostgresConf
+var SSLModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// sslAttempts are the sslmodes lib/pq connects with for each sslmode, in order until one connects
+// lib/pq has no allow and prefer, they try without and with TLS like libpq does
+var sslAttempts = map[string][]string{
+	"disable":     {"disable"},
+	"allow":       {"disable", "require"},
+	"prefer":      {"require", "disable"},
+	"require":     {"require"},
+	"verify-ca":   {"verify-ca"},
+	"verify-full": {"verify-full"},
+}
+
+// DSN returns the connection string of conf for lib/pq, connecting with sslmode
+// The password is read from PasswordFile if it is set
+func (c PostgresConf) DSN(sslmode string) (string, error) {
+	password := c.Password
+	if c.PasswordFile != "" {
+		b, err := os.ReadFile(c.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("reading the postgres password: %w", err)
+		}
+		password = strings.TrimRight(string(b), "\r\n")
+	}
+	params := [][2]string{
+		{"host", c.Host},
+		{"port", fmt.Sprint(c.Port)},
+		{"user", c.User},
+		{"password", password},
+		{"dbname", c.DBname},
+		{"sslmode", sslmode},
+		{"sslrootcert", c.SSLRootCert},
+		{"sslcert", c.SSLCert},
+		{"sslkey", c.SSLKey},
+	}
+	if c.StatementTimeout > 0 {
+		// not a lib/pq setting, it is sent to the server as a run-time parameter
+		params = append(params, [2]string{"statement_timeout", fmt.Sprint(c.StatementTimeout.Milliseconds())})
+	}
+	var dsn strings.Builder
+	for _, p := range params {
+		if p[1] == "" {
+			continue
+		}
+		if dsn.Len() > 0 {
+			dsn.WriteByte(' ')
+		}
+		dsn.WriteString(p[0] + "=" + quoteDSNValue(p[1]))
+	}
+	return dsn.String(), nil
+}
+
+// quoteDSNValue quotes a value of a connection string, escaping its quotes and backslashes
+func quoteDSNValue(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+// postgresConnector opens connections to postgres with conf, building the connection string for each of them so
+// a rotated PasswordFile is picked up
+type postgresConnector struct {
+	conf PostgresConf
+}
+
+// Connect connects with each sslmode the SSLMode of conf tries, returns the error of the last one if none connects
+func (c postgresConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	attempts, ok := sslAttempts[c.conf.SSLMode]
+	if !ok {
+		return nil, fmt.Errorf("unknown postgres sslmode %q", c.conf.SSLMode)
+	}
+	var err error
+	for _, sslmode := range attempts {
+		var dsn string
+		dsn, err = c.conf.DSN(sslmode)
+		if err != nil {
+			return nil, err
+		}
+		var connector *pq.Connector
+		connector, err = pq.NewConnector(dsn)
+		if err != nil {
+			return nil, err
+		}
+		var conn driver.Conn
+		conn, err = connector.Connect(ctx)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func (c postgresConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"database/sql"
+	"find_providers/pkg/model"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+// WriteFailedEntryToDB writes an entry that failed to be processed to the failed_entries table
+func (db *DB) WriteFailedEntryToDB(f model.FailedEntry) error {
+	if db.dbToUse != "postgres" {
+		return fmt.Errorf("failed entries are not supported on %v", db.dbToUse)
+	}
+	// entries failing for invalid utf8 are kept with it replaced, postgres refuses it
+	_, err := db.db.Exec(`
+			INSERT INTO public.failed_entries
+			(stage, reason, entry, cid, source, failed_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			`, f.Stage, strings.ToValidUTF8(f.Reason, "\uFFFD"), strings.ToValidUTF8(f.Entry, "\uFFFD"),
+		checkIfValidString(f.Cid), f.Source, f.FailedAt)
+	return err
+}
+
+// redrivePage is how many failed entries are claimed at a time, and redriveLease how long they are claimed for
+const (
+	redrivePage  = 100
+	redriveLease = 5 * time.Minute
+)
+
+// RedriveFailedEntries calls f for the oldest failed entries, at most limit of them (all if limit is 0), and only
+// those failed at the given stage unless it is empty. The entries f succeeds for are deleted from the table.
+// Entries are claimed a page at a time without holding a transaction open while f runs, those claimed by a concurrent
+// re-drive are skipped. Stops at the first entry f fails for. Returns how many entries were re-driven
+func (db *DB) RedriveFailedEntries(stage string, limit int, f func(model.FailedEntry) error) (int, error) {
+	if db.dbToUse != "postgres" {
+		return 0, fmt.Errorf("failed entries are not supported on %v", db.dbToUse)
+	}
+	n := 0
+	for limit == 0 || n < limit {
+		page := redrivePage
+		if limit > 0 && limit-n < page {
+			page = limit - n
+		}
+		entries, err := db.claimFailedEntries(stage, page)
+		if err != nil || len(entries) == 0 {
+			return n, err
+		}
+
+		var redriven []int64
+		var redriveErr error
+		for _, e := range entries {
+			if redriveErr = f(e); redriveErr != nil {
+				break
+			}
+			redriven = append(redriven, e.Id)
+		}
+		if _, err := db.db.Exec(`DELETE FROM public.failed_entries WHERE id = ANY($1)`, pq.Array(redriven)); err != nil {
+			return n, fmt.Errorf("deleting %v re-driven entries, they will be re-driven again: %v", len(redriven), err)
+		}
+		n += len(redriven)
+		if redriveErr != nil {
+			// release this entry and the ones not re-driven yet
+			var kept []int64
+			for _, e := range entries[len(redriven):] {
+				kept = append(kept, e.Id)
+			}
+			if _, err := db.db.Exec(`UPDATE public.failed_entries SET redrive_until = NULL WHERE id = ANY($1)`,
+				pq.Array(kept)); err != nil {
+				log.Warning("Error releasing failed entries, they are re-driven once their claim expires: ", err)
+			}
+			return n, redriveErr
+		}
+	}
+	return n, nil
+}
+
+// claimFailedEntries claims the oldest limit failed entries of the stage (of any stage if it is empty) that are not
+// claimed by someone else, for redriveLease
+func (db *DB) claimFailedEntries(stage string, limit int) ([]model.FailedEntry, error) {
+	rows, err := db.db.Query(`
+			UPDATE public.failed_entries SET redrive_until = now() + make_interval(secs => $3)
+			WHERE id IN (
+			    SELECT id FROM public.failed_entries
+			    WHERE ($1 = '' OR stage = $1) AND (redrive_until IS NULL OR redrive_until < now())
+			    ORDER BY failed_at
+			    LIMIT $2
+			    FOR UPDATE SKIP LOCKED)
+			RETURNING id, stage, reason, entry, cid, source, failed_at
+			`, stage, limit, redriveLease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []model.FailedEntry
+	for rows.Next() {
+		var e model.FailedEntry
+		var cid sql.NullString
+		if err := rows.Scan(&e.Id, &e.Stage, &e.Reason, &e.Entry, &cid, &e.Source, &e.FailedAt); err != nil {
+			return nil, err
+		}
+		e.Cid = cid.String
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// RETURNING does not keep the order of the subquery
+	sort.Slice(entries, func(i, j int) bool { return entries[i].FailedAt.Before(entries[j].FailedAt) })
+	return entries, nil
+}
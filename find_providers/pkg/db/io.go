@@ -7,7 +7,7 @@ import (
 	"fmt"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 	"strings"
 	"time"
@@ -15,6 +15,7 @@ import (
 
 type DB struct {
 	dbToUse  string
+	client   influxdb2.Client
 	writeAPI api.WriteAPIBlocking
 	db       *sql.DB
 }
@@ -34,6 +35,7 @@ type dbWritable struct {
 }
 
 // PrepareDB prepares the database for writing
+// The postgres schema is migrated to the version of the binary with Migrate, and must be at it otherwise
 func PrepareDB(dbToUse string, conf Config) *DB {
 	log.Debug("Preparing database..")
 
@@ -43,97 +45,173 @@ func PrepareDB(dbToUse string, conf Config) *DB {
 		db:       nil,
 	}
 
-	var err error
 	switch dbToUse {
 	case "postgres":
 		pconf := conf.(PostgresConf)
-		psqlInfo := fmt.Sprintf("host=%s port=%d user=%s "+
-			"dbname=%s sslmode=disable",
-			pconf.Host, pconf.Port, pconf.User, pconf.DBname)
-
-		log.Println("Opening connection to postgres database..")
-		db.db, err = sql.Open("postgres", psqlInfo)
-		if err != nil {
-			panic(err)
-		}
-		err = db.db.Ping()
-		if err != nil {
+		db.db = openPostgres(pconf)
+		if err := db.checkSchema(pconf.Migrate); err != nil {
 			panic(err)
 		}
 
 	case "influx":
 		iconf := conf.(InfluxDBConf)
 		log.Println("Opening connection to influxdb..")
-		client := influxdb2.NewClient(iconf.DBUrl, iconf.Token)
-		db.writeAPI = client.WriteAPIBlocking(iconf.Org, iconf.Bucket)
+		db.client = influxdb2.NewClient(iconf.DBUrl, iconf.Token)
+		db.writeAPI = db.client.WriteAPIBlocking(iconf.Org, iconf.Bucket)
 	}
 
 	return db
 }
 
+// openPostgres opens the connection pool to the postgres database
+func openPostgres(pconf PostgresConf) *sql.DB {
+	log.Println("Opening connection to postgres database..")
+	db := sql.OpenDB(postgresConnector{conf: pconf})
+	db.SetMaxOpenConns(pconf.MaxOpenConns)
+	db.SetMaxIdleConns(pconf.MaxIdleConns)
+	db.SetConnMaxLifetime(pconf.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(pconf.ConnMaxIdleTime)
+	err := db.Ping()
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+// Close closes the connection to the database
+func (db *DB) Close() error {
+	switch db.dbToUse {
+	case "postgres":
+		return db.db.Close()
+	case "influx":
+		db.client.Close()
+	}
+	return nil
+}
+
 // WriteEntryToDB writes the entry to the database
-func (db *DB) WriteEntryToDB(e model.EntryStruct, reqId string) {
-	log.Debug("Writing to db request of cid", e.Cid)
+func (db *DB) WriteEntryToDB(e model.EntryStruct, reqId string) error {
+	log.Debug("Writing to db request ", reqId, " of cid ", e.Cid)
+	if err := validateEntry(e, reqId); err != nil {
+		return err
+	}
 	switch db.dbToUse {
 	case "postgres":
-		db.writeEntryToPostgres(e, reqId)
+		return db.writeEntryToPostgres(e, reqId)
 	case "influx":
-		db.writeEntryToInfluxDB(e)
+		return db.writeEntryToInfluxDB(e)
 	}
+	return nil
 }
 
 // writeEntryToPostgres writes the entry to the postgres database
-func (db *DB) writeEntryToPostgres(e model.EntryStruct, reqId string) {
+func (db *DB) writeEntryToPostgres(e model.EntryStruct, reqId string) error {
+	placeholders := make([]string, len(requestColumns))
+	for i := range placeholders {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
 	sqlStatement := `INSERT INTO public.requests 
-			(req_id, timestamp, cid, continent, country, region, lat, long, asn, aso,
-			request_time, upstream_time,
-			body_bytes, user_agent, cache, status, host)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+			(` + strings.Join(requestColumns, ", ") + `)
+			VALUES (` + strings.Join(placeholders, ", ") + `)
 			ON CONFLICT ON CONSTRAINT requests_pkey DO
 			NOTHING 
 			`
-	_, err := db.db.Exec(sqlStatement, reqId, e.Time, e.Cid, checkIfValidString(e.Continent), checkIfValidString(e.Country), checkIfValidString(e.Region), checkIfValidFloat(e.Lat), checkIfValidFloat(e.Long), checkIfValidInt(e.ASN), checkIfValidString(e.ASO),
-		checkIfValidFloat(e.RequestTime), checkIfValidFloat(e.UpstreamResponseTime[0]), checkIfValidFloat(e.BodyBytes), checkIfValidString(e.HttpUserAgent), checkIfValidString(e.Cache), checkIfValidInt(e.Status), checkIfValidString(e.HttpHost))
-	if err != nil {
-		log.Println(err, "on", e)
+	_, err := db.db.Exec(sqlStatement, entryRow(e, reqId)...)
+	return err
+}
+
+// requestColumns are the columns of the requests table written for an entry, in the order of entryRow
+var requestColumns = []string{"req_id", "timestamp", "cid", "continent", "country", "region", "lat", "long", "asn", "aso",
+	"request_time", "upstream_time", "body_bytes", "user_agent", "cache", "status", "host",
+	"upstream_attempts", "upstream_response_times", "upstream_header_times", "upstream_response_time_sum",
+	"upstream_header_time_sum", "request_length", "scheme", "referer", "server_name"}
+
+// entryRow returns the values of the requests table row of an entry
+func entryRow(e model.EntryStruct, reqId string) []interface{} {
+	responseTimes, headerTimes := upstreamTimes(e.UpstreamResponseTime), upstreamTimes(e.UpstreamHeaderTime)
+	var upstreamTime sql.NullFloat64
+	if len(responseTimes) > 0 {
+		upstreamTime = responseTimes[0]
+	}
+	return []interface{}{reqId, e.Time, e.Cid, checkIfValidString(e.Continent), checkIfValidString(e.Country), checkIfValidString(e.Region), checkIfValidFloat(e.Lat), checkIfValidFloat(e.Long), checkIfValidInt(e.ASN), checkIfValidString(e.ASO),
+		checkIfValidFloat(e.RequestTime), upstreamTime, checkIfValidFloat(e.BodyBytes), checkIfValidString(e.HttpUserAgent), checkIfValidString(e.Cache), checkIfValidInt(e.Status), checkIfValidString(e.HttpHost),
+		len(responseTimes), pq.Array(responseTimes), pq.Array(headerTimes), sumOfValid(responseTimes),
+		sumOfValid(headerTimes), checkIfValidInt(e.RequestLength), checkIfValidString(e.Scheme), checkIfValidString(e.HttpRefer), checkIfValidString(e.ServerName)}
+}
+
+// upstreamTimes returns the times of the upstream attempts of an entry, none if nginx logged "-" as the request was
+// not proxied
+func upstreamTimes(times []string) []sql.NullFloat64 {
+	if len(times) == 0 || (len(times) == 1 && times[0] == "-") {
+		return nil
 	}
+	return checkIfValidFloats(times)
 }
 
 // writeEntryToInfluxDB writes the entry to the influxdb database
-func (db *DB) writeEntryToInfluxDB(e model.EntryStruct) {
+func (db *DB) writeEntryToInfluxDB(e model.EntryStruct) error {
+	responseTimes, headerTimes := upstreamTimes(e.UpstreamResponseTime), upstreamTimes(e.UpstreamHeaderTime)
+	fields := map[string]interface{}{
+		"regions":      e.Region,
+		"request time": e.RequestTime, "upstream time": firstOrEmpty(e.UpstreamResponseTime),
+		"body bytes": e.BodyBytes, "user agent": e.HttpUserAgent, "cache": e.Cache,
+		"request length": e.RequestLength, "scheme": e.Scheme, "referer": e.HttpRefer, "server name": e.ServerName,
+		// fields cannot be arrays, the times of the attempts are kept as nginx logs them
+		"upstream attempts":       len(responseTimes),
+		"upstream response times": strings.Join(e.UpstreamResponseTime, ", "),
+		"upstream header times":   strings.Join(e.UpstreamHeaderTime, ", "),
+	}
+	if sum := sumOfValid(responseTimes); sum.Valid {
+		fields["upstream response time sum"] = sum.Float64
+	}
+	if sum := sumOfValid(headerTimes); sum.Valid {
+		fields["upstream header time sum"] = sum.Float64
+	}
 	p := influxdb2.NewPoint("requests",
 		map[string]string{"cid": e.Cid, "continent": e.Continent, "country": e.Country},
-		map[string]interface{}{
-			"regions":      e.Region,
-			"request time": e.RequestTime, "upstream time": e.UpstreamResponseTime,
-			"body bytes": e.BodyBytes, "user agent": e.HttpUserAgent, "cache": e.Cache},
+		fields,
 		e.Time,
 		//time.Now(),
 	)
-	err := db.writeAPI.WritePoint(context.Background(), p)
-	if err != nil {
-		panic(err)
+	return db.writeAPI.WritePoint(context.Background(), p)
+}
+
+// firstOrEmpty returns the first string, empty if there are none
+func firstOrEmpty(ss []string) string {
+	if len(ss) == 0 {
+		return ""
 	}
+	return ss[0]
 }
 
 // WriteProvidersToDB  writes the provider to the database
-func (db *DB) WriteProvidersToDB(t time.Time, n time.Time, ans model.JsonAnswer) {
+// Every provider is written even if some fail, the first error is returned
+func (db *DB) WriteProvidersToDB(t time.Time, n time.Time, ans model.JsonAnswer) error {
 	log.Debug("Writing to db providers of cid", ans.Cid)
+	if err := validateProviders(ans); err != nil {
+		return err
+	}
+	var firstErr error
 	for _, prov := range ans.Providers {
 		for _, locs := range prov.Locations {
 			log.Println("Writing to db provider", prov.PeerId, " loc:", locs.Continent)
+			var err error
 			switch db.dbToUse {
 			case "postgres":
-				db.writeProviderToPostgres(t, n, ans, prov, locs)
+				err = db.writeProviderToPostgres(t, n, ans, prov, locs)
 			case "influx":
-				db.writeProviderToInfluxDB(t, n, ans, prov, locs)
+				err = db.writeProviderToInfluxDB(t, n, ans, prov, locs)
+			}
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("writing provider %v: %v", prov.PeerId, err)
 			}
 		}
 	}
+	return firstErr
 }
 
 // writeProviderToPostgres writes the provider to the postgres database
-func (db *DB) writeProviderToPostgres(t time.Time, n time.Time, ans model.JsonAnswer, prov model.Provider, locs model.Location) {
+func (db *DB) writeProviderToPostgres(t time.Time, n time.Time, ans model.JsonAnswer, prov model.Provider, locs model.Location) error {
 	sqlStatement := `
 			INSERT INTO public.providers
 			(cid, continent, country, region, lat, long, asn, aso,
@@ -149,16 +227,59 @@ func (db *DB) writeProviderToPostgres(t time.Time, n time.Time, ans model.JsonAn
    			    aso=COALESCE(NULLIF($8, ''), providers.aso),
    			    updated_at = $12
 			`
-	_, err := db.db.Exec(sqlStatement, ans.Cid, checkIfValidString(locs.Continent), checkIfValidString(locs.Country), checkIfValidString(locs.Region), checkIfValidFloat(locs.Lat), checkIfValidFloat(locs.Long), checkIfValidInt(locs.ASN), checkIfValidString(locs.ASO),
-		ans.Dur, checkIfValidString(strings.Trim(prov.PeerId, "{}")), n, n)
+	_, err := db.db.Exec(sqlStatement, providerRow(n, ans, prov, locs)...)
 	if err != nil {
 		log.Println(err, "on", ans.Cid, locs.Continent, locs.Country, locs.Region, locs.Lat, locs.Long, locs.ASN, locs.ASO,
 			ans.Dur, prov.PeerId)
 	}
+	return err
+}
+
+// providerColumns are the columns of the providers table written for a provider location, in the order of providerRow
+var providerColumns = []string{"cid", "continent", "country", "region", "lat", "long", "asn", "aso",
+	"request_time", "peerid", "found_at", "updated_at"}
+
+// providerRow returns the values of the providers table row of a provider location found at n
+func providerRow(n time.Time, ans model.JsonAnswer, prov model.Provider, locs model.Location) []interface{} {
+	return []interface{}{ans.Cid, checkIfValidString(locs.Continent), checkIfValidString(locs.Country), checkIfValidString(locs.Region), checkIfValidFloat(locs.Lat), checkIfValidFloat(locs.Long), checkIfValidInt(locs.ASN), checkIfValidString(locs.ASO),
+		ans.Dur, checkIfValidString(strings.Trim(prov.PeerId, "{}")), n, n}
+}
+
+// LoadProviderLookups calls f for the most recently updated cids in the providers table, at most limit of them,
+// with the last time their providers were updated since the given time, from the oldest to the newest
+func (db *DB) LoadProviderLookups(since time.Time, limit int, f func(cid string, at time.Time)) (int, error) {
+	if db.dbToUse != "postgres" {
+		return 0, fmt.Errorf("loading provider lookups is not supported on %v", db.dbToUse)
+	}
+	rows, err := db.db.Query(`
+			SELECT cid, updated_at FROM (
+				SELECT cid, max(updated_at) AS updated_at FROM public.providers
+				WHERE updated_at > $1
+				GROUP BY cid
+				ORDER BY updated_at DESC
+				LIMIT $2
+			) recent ORDER BY updated_at
+			`, since, limit)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var cid string
+		var at time.Time
+		if err := rows.Scan(&cid, &at); err != nil {
+			return n, err
+		}
+		f(cid, at)
+		n++
+	}
+	return n, rows.Err()
 }
 
 // writeProviderToInfluxDB writes the provider to the influxdb database
-func (db *DB) writeProviderToInfluxDB(t time.Time, n time.Time, ans model.JsonAnswer, prov model.Provider, locs model.Location) {
+func (db *DB) writeProviderToInfluxDB(t time.Time, n time.Time, ans model.JsonAnswer, prov model.Provider, locs model.Location) error {
 	p := influxdb2.NewPoint("providers",
 		map[string]string{"cid": ans.Cid, "continent": locs.Continent, "country": locs.Country},
 		map[string]interface{}{"peerID": prov.PeerId,
@@ -167,8 +288,5 @@ func (db *DB) writeProviderToInfluxDB(t time.Time, n time.Time, ans model.JsonAn
 			"request time": ans.Dur.Milliseconds(), "request at": n},
 		t,
 	)
-	err := db.writeAPI.WritePoint(context.Background(), p)
-	if err != nil {
-		panic(err)
-	}
+	return db.writeAPI.WritePoint(context.Background(), p)
 }
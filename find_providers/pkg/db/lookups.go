@@ -0,0 +1,44 @@
+package db
+
+import (
+	"context"
+	"find_providers/pkg/model"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// WriteLookupToDB writes the outcome of a lookup to the database
+func (db *DB) WriteLookupToDB(l model.Lookup) error {
+	log.Debug("Writing to db lookup of cid", l.Cid)
+	switch db.dbToUse {
+	case "postgres":
+		return db.writeLookupToPostgres(l)
+	case "influx":
+		return db.writeLookupToInfluxDB(l)
+	}
+	return nil
+}
+
+// writeLookupToPostgres writes the outcome of a lookup to the postgres database
+func (db *DB) writeLookupToPostgres(l model.Lookup) error {
+	sqlStatement := `INSERT INTO public.lookups
+			(cid, started_at, ended_at, duration, providers, error_class, error, source)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			`
+	_, err := db.db.Exec(sqlStatement, l.Cid, l.StartedAt, l.EndedAt, l.Duration(), l.Providers,
+		checkIfValidString(l.ErrorClass), checkIfValidString(l.Error), l.Source)
+	return err
+}
+
+// writeLookupToInfluxDB writes the outcome of a lookup to the influxdb database
+func (db *DB) writeLookupToInfluxDB(l model.Lookup) error {
+	p := influxdb2.NewPoint("lookups",
+		map[string]string{"cid": l.Cid, "error class": l.ErrorClass, "source": l.Source},
+		map[string]interface{}{
+			"providers": l.Providers, "duration": l.Duration().Milliseconds(),
+			"error": l.Error, "ended at": l.EndedAt},
+		l.StartedAt,
+	)
+	return db.writeAPI.WritePoint(context.Background(), p)
+}
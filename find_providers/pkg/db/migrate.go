@@ -0,0 +1,326 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// migrationFiles are the migrations of the postgres schema, NNNN_name.up.sql and NNNN_name.down.sql
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLock is the key of the advisory lock taken while migrating, so concurrent starts migrate once
+const migrationLock = 7291846301
+
+// Migration is a version of the postgres schema, Up migrates to it from the version before and Down back
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus is a migration and when it was applied, zero if it was not
+type MigrationStatus struct {
+	Migration
+	AppliedAt time.Time
+}
+
+// Migrations returns the migrations embedded in the binary, by version
+func Migrations() ([]Migration, error) {
+	files, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, f := range files {
+		name := f.Name()
+		base, direction := strings.TrimSuffix(name, ".up.sql"), "up"
+		if base == name {
+			base, direction = strings.TrimSuffix(name, ".down.sql"), "down"
+		}
+		i := strings.IndexByte(base, '_')
+		if base == name || i < 0 {
+			return nil, fmt.Errorf("migration %s is not named NNNN_name.up.sql or NNNN_name.down.sql", name)
+		}
+		version, err := strconv.Atoi(base[:i])
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s does not start with a positive version", name)
+		}
+		body, err := migrationFiles.ReadFile("migrations/" + name)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: base[i+1:]}
+			byVersion[version] = m
+		} else if m.Name != base[i+1:] {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", m.Name, base[i+1:], version)
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d_%s is not version %d, versions must follow each other", m.Version, m.Name, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// PrepareMigrationDB prepares the postgres database for migrating it, without checking its schema version
+func PrepareMigrationDB(conf PostgresConf) *DB {
+	db := &DB{dbToUse: "postgres"}
+	db.db = openPostgres(conf)
+	return db
+}
+
+// checkSchema checks that the schema is at the version of the last migration, applying the pending ones if migrate
+// Refuses a schema newer than the binary or with migrations it does not know, it was migrated by another version
+func (db *DB) checkSchema(migrate bool) error {
+	migrations, err := Migrations()
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].Version
+	if migrate {
+		applied, err := db.MigrateUp()
+		if err != nil {
+			return err
+		}
+		if applied > 0 {
+			log.Infoln("Migrated the database schema to version", latest, "applying", applied, "migrations")
+		}
+		return nil
+	}
+	version, err := schemaVersion(context.Background(), db.db, migrations)
+	if err != nil {
+		return err
+	}
+	if version != latest {
+		return fmt.Errorf("database schema is at version %d, expected %d: run migrate up", version, latest)
+	}
+	return nil
+}
+
+// SchemaVersion returns the version of the last migration applied to the database, 0 if none was
+// Fails if the database holds migrations the binary does not know
+func (db *DB) SchemaVersion() (int, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+	return schemaVersion(context.Background(), db.db, migrations)
+}
+
+// querier runs queries on the database or on a connection of it
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// schemaVersion returns the version the schema was migrated to, checking it took exactly the known migrations up to it
+func schemaVersion(ctx context.Context, q querier, migrations []Migration) (int, error) {
+	applied, err := appliedMigrations(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+	versions := make([]int, 0, len(applied))
+	for v := range applied {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	for i, v := range versions {
+		if v > len(migrations) {
+			return 0, fmt.Errorf("database schema is at version %d, newer than the %d migrations known: upgrade first",
+				versions[len(versions)-1], len(migrations))
+		}
+		if v != i+1 {
+			return 0, fmt.Errorf("database schema misses migration %d but has migration %d", i+1, v)
+		}
+	}
+	return len(versions), nil
+}
+
+// appliedMigrations returns when each migration applied to the database was, none if it was never migrated
+func appliedMigrations(ctx context.Context, q querier) (map[int]time.Time, error) {
+	var table sql.NullString
+	if err := q.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations')::text`).Scan(&table); err != nil {
+		return nil, err
+	}
+	applied := map[int]time.Time{}
+	if !table.Valid {
+		return applied, nil
+	}
+	rows, err := q.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// MigrationStatus returns the migrations known and when they were applied to the database
+func (db *DB) MigrationStatus() ([]MigrationStatus, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(context.Background(), db.db)
+	if err != nil {
+		return nil, err
+	}
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status = append(status, MigrationStatus{Migration: m, AppliedAt: applied[m.Version]})
+	}
+	return status, nil
+}
+
+// MigrateUp applies the pending migrations, each in its own transaction, and returns how many it applied
+func (db *DB) MigrateUp() (int, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+	applied := 0
+	err = db.withMigrationLock(func(ctx context.Context, conn *sql.Conn) error {
+		version, err := schemaVersion(ctx, conn, migrations)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations[version:] {
+			log.Infoln("Applying migration", m.Version, m.Name)
+			err := inTx(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, m.Up); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, now())`,
+					m.Version, m.Name)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			applied++
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// MigrateDown reverts the last steps migrations applied, each in its own transaction, and returns how many it reverted
+func (db *DB) MigrateDown(steps int) (int, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, err
+	}
+	reverted := 0
+	err = db.withMigrationLock(func(ctx context.Context, conn *sql.Conn) error {
+		version, err := schemaVersion(ctx, conn, migrations)
+		if err != nil {
+			return err
+		}
+		for ; reverted < steps && version > 0; version-- {
+			m := migrations[version-1]
+			log.Infoln("Reverting migration", m.Version, m.Name)
+			err := inTx(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, m.Down); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, m.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			reverted++
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// withMigrationLock runs f on a connection holding the migration lock, creating the schema_migrations table first
+func (db *DB) withMigrationLock(f func(ctx context.Context, conn *sql.Conn) error) error {
+	if db.dbToUse != "postgres" {
+		return fmt.Errorf("migrations are not supported on %v", db.dbToUse)
+	}
+	ctx := context.Background()
+	conn, err := db.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// waiting for the lock and migrating large tables may take longer than statement_timeout
+	if _, err := conn.ExecContext(ctx, `SET statement_timeout = 0`); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, `RESET statement_timeout`); err != nil {
+			log.Warning("Error resetting the statement timeout: ", err)
+		}
+	}()
+	// session locks are held by the connection, they are released if the process dies
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLock); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLock); err != nil {
+			log.Warning("Error releasing the migration lock: ", err)
+		}
+	}()
+	_, err = conn.ExecContext(ctx, `
+			CREATE TABLE IF NOT EXISTS schema_migrations (
+				version int primary key,
+				name text not null,
+				applied_at timestamptz not null
+			)`)
+	if err != nil {
+		return err
+	}
+	return f(ctx, conn)
+}
+
+// inTx runs f in a transaction on conn, committed if f succeeds and rolled back otherwise
+func inTx(ctx context.Context, conn *sql.Conn, f func(tx *sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS failed_entries;
+DROP TABLE IF EXISTS lookup_claims;
+DROP TABLE IF EXISTS lookups;
+DROP TABLE IF EXISTS providers;
+DROP TABLE IF EXISTS requests;
@@ -0,0 +1,70 @@
+-- The tables of the pipeline, as create_database.sql created them. Databases it created are taken over as they are
+
+CREATE TABLE IF NOT EXISTS requests (
+    req_id text primary key,
+    timestamp TIMESTAMP not null,
+    cid VARCHAR(100) not null,
+    continent char(2),
+    country char(2),
+    region varchar(5),
+    lat float,
+    long float,
+    asn int,
+    aso text,
+    request_time float,
+    upstream_time float,
+    body_bytes bigint,
+    user_agent text,
+    cache text,
+    status int,
+    host text
+);
+
+CREATE TABLE IF NOT EXISTS providers (
+    cid VARCHAR(100) not null,
+    continent char(2),
+    country char(2),
+    region varchar(5),
+    lat float,
+    long float,
+    asn int,
+    aso text,
+    request_time float,
+    peerID varchar(100),
+    found_at timestamp,
+    updated_at timestamp,
+    primary key (cid, peerID)
+);
+
+CREATE TABLE IF NOT EXISTS lookups (
+    id bigserial primary key,
+    cid VARCHAR(100) not null,
+    started_at timestamp not null,
+    ended_at timestamp not null,
+    duration float,
+    providers int not null,
+    error_class varchar(20),
+    error text,
+    source varchar(20) not null
+);
+
+CREATE TABLE IF NOT EXISTS lookup_claims (
+    cid VARCHAR(100) primary key,
+    owner text not null,
+    expires_at timestamptz not null
+);
+
+CREATE TABLE IF NOT EXISTS failed_entries (
+    id bigserial primary key,
+    stage varchar(20) not null,
+    reason text not null,
+    entry text not null,
+    cid VARCHAR(100),
+    source text not null,
+    failed_at timestamp not null
+);
+
+CREATE INDEX IF NOT EXISTS requests_timestamp_idx ON requests(timestamp);
+CREATE INDEX IF NOT EXISTS lookups_cid_idx ON lookups(cid);
+CREATE INDEX IF NOT EXISTS lookups_started_at_idx ON lookups(started_at);
+CREATE INDEX IF NOT EXISTS failed_entries_failed_at_idx ON failed_entries(failed_at);
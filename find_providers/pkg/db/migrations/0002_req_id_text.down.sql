@@ -0,0 +1,13 @@
+-- Request ids go back to raw SHA-256 bytes, decoding the hex ids. Ids written with another controller.request_id_encoding
+-- (base32) have no bytes to go back to, the migration fails on them, leaving the table as it is, rather than lose them
+DO $$
+DECLARE
+    bad text;
+BEGIN
+    SELECT req_id INTO bad FROM requests WHERE req_id !~ '^[0-9a-fA-F]{64}$' LIMIT 1;
+    IF FOUND THEN
+        RAISE EXCEPTION 'cannot revert requests.req_id to bytea, % is not a hex id, delete or re-encode the ids that are not hex first', bad;
+    END IF;
+    ALTER TABLE requests ALTER COLUMN req_id TYPE bytea USING decode(req_id, 'hex');
+END
+$$;
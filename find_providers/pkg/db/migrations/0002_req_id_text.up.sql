@@ -0,0 +1,11 @@
+-- Databases created before request ids were text hold them as raw SHA-256 bytes. They are hex encoded, which is the
+-- id the controller generates for the same entry with the default controller.request_id_fields and
+-- controller.request_id_encoding (hex)
+DO $$
+BEGIN
+    IF (SELECT data_type FROM information_schema.columns
+        WHERE table_schema = current_schema() AND table_name = 'requests' AND column_name = 'req_id') = 'bytea' THEN
+        ALTER TABLE requests ALTER COLUMN req_id TYPE text USING encode(req_id, 'hex');
+    END IF;
+END
+$$;
@@ -0,0 +1,10 @@
+ALTER TABLE requests
+    DROP COLUMN upstream_attempts,
+    DROP COLUMN upstream_response_times,
+    DROP COLUMN upstream_header_times,
+    DROP COLUMN upstream_response_time_sum,
+    DROP COLUMN upstream_header_time_sum,
+    DROP COLUMN request_length,
+    DROP COLUMN scheme,
+    DROP COLUMN referer,
+    DROP COLUMN server_name;
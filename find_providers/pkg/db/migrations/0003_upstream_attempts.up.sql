@@ -0,0 +1,12 @@
+-- Every upstream attempt of a request, upstream_time stays the response time of the first one, and the fields of the
+-- log entries that were not stored. Attempts nginx has no time for are NULL in the arrays and left out of the sums
+ALTER TABLE requests
+    ADD COLUMN upstream_attempts int,
+    ADD COLUMN upstream_response_times float[],
+    ADD COLUMN upstream_header_times float[],
+    ADD COLUMN upstream_response_time_sum float,
+    ADD COLUMN upstream_header_time_sum float,
+    ADD COLUMN request_length bigint,
+    ADD COLUMN scheme text,
+    ADD COLUMN referer text,
+    ADD COLUMN server_name text;
@@ -0,0 +1 @@
+ALTER TABLE failed_entries DROP COLUMN redrive_until;
@@ -0,0 +1,3 @@
+-- Failed entries being re-driven are claimed until redrive_until, so concurrent re-drives skip them without holding a
+-- transaction open while they are published. A claim left by a re-drive that stopped expires on its own
+ALTER TABLE failed_entries ADD COLUMN redrive_until timestamptz;
@@ -2,19 +2,18 @@ package db
 
 import (
 	"database/sql"
+	"find_providers/pkg/model"
 	"fmt"
 	"strconv"
 	"unicode/utf8"
 )
 
-// checkIfValidString checks if a string is valid utf8
+// checkIfValidString checks if a string is valid utf8, invalid ones are null
+// Rows are checked by validateEntry and validateProviders before they are written, which rejects them instead
 func checkIfValidString(s string) sql.NullString {
-	if len(s) == 0 {
+	if len(s) == 0 || !utf8.ValidString(s) {
 		return sql.NullString{}
 	} else {
-		if !utf8.Valid([]byte(s)) {
-			panic(fmt.Sprintf("String %v is not valid utf8", s))
-		}
 		return sql.NullString{
 			String: s,
 			Valid:  true,
@@ -22,6 +21,42 @@ func checkIfValidString(s string) sql.NullString {
 	}
 }
 
+// validateStrings returns an error naming the first field that is not valid utf8, which postgres refuses
+func validateStrings(fields ...string) error {
+	for i := 0; i+1 < len(fields); i += 2 {
+		if !utf8.ValidString(fields[i+1]) {
+			return fmt.Errorf("%v %q is not valid utf8", fields[i], fields[i+1])
+		}
+	}
+	return nil
+}
+
+// validateEntry checks the text columns of the requests row of an entry
+func validateEntry(e model.EntryStruct, reqId string) error {
+	return validateStrings("req_id", reqId, "cid", e.Cid, "continent", e.Continent, "country", e.Country,
+		"region", e.Region, "aso", e.ASO, "user_agent", e.HttpUserAgent, "cache", e.Cache, "host", e.HttpHost,
+		"scheme", e.Scheme, "referer", e.HttpRefer, "server_name", e.ServerName)
+}
+
+// validateProviders checks the text columns of the providers rows of a lookup
+func validateProviders(ans model.JsonAnswer) error {
+	if err := validateStrings("cid", ans.Cid); err != nil {
+		return err
+	}
+	for _, prov := range ans.Providers {
+		if err := validateStrings("peerID", prov.PeerId); err != nil {
+			return err
+		}
+		for _, locs := range prov.Locations {
+			if err := validateStrings("continent", locs.Continent, "country", locs.Country, "region", locs.Region,
+				"aso", locs.ASO); err != nil {
+				return fmt.Errorf("provider %v: %v", prov.PeerId, err)
+			}
+		}
+	}
+	return nil
+}
+
 // checkIfValidInt checks if a string has size 0 to return a valid null int
 func checkIfValidInt(s string) sql.NullInt32 {
 	if len(s) == 0 {
@@ -53,3 +88,24 @@ func checkIfValidFloat(s string) sql.NullFloat64 {
 		}
 	}
 }
+
+// checkIfValidFloats converts every string to a valid null float, as checkIfValidFloat does
+func checkIfValidFloats(ss []string) []sql.NullFloat64 {
+	fs := make([]sql.NullFloat64, len(ss))
+	for i, s := range ss {
+		fs[i] = checkIfValidFloat(s)
+	}
+	return fs
+}
+
+// sumOfValid sums the valid floats, it is null if none is
+func sumOfValid(fs []sql.NullFloat64) sql.NullFloat64 {
+	var sum sql.NullFloat64
+	for _, f := range fs {
+		if f.Valid {
+			sum.Float64 += f.Float64
+			sum.Valid = true
+		}
+	}
+	return sum
+}
@@ -0,0 +1,9 @@
+package deadletter
+
+// Conf selects where failed log entries are sent
+type Conf struct {
+	// Type is none, table (the failed_entries table of the postgres database) or queue (a broker queue)
+	Type string `yaml:"type" toml:"type"`
+	// Topic is the broker queue of the queue sink
+	Topic string `yaml:"topic" toml:"topic"`
+}
@@ -0,0 +1,122 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"find_providers/pkg/broker"
+	"find_providers/pkg/db"
+	"find_providers/pkg/model"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stages of the pipeline at which a log entry can fail
+const (
+	StageParse          = "parse"
+	StageLookup         = "lookup"
+	StageWriteEntry     = "write_entry"
+	StageWriteProviders = "write_providers"
+)
+
+// lookupPrefix starts the entries of the lookups that failed, which are not log entries
+const lookupPrefix = "lookup "
+
+// Sink keeps the log entries that failed to be processed
+type Sink interface {
+	Send(f model.FailedEntry) error
+	Close() error
+}
+
+// PrepareSink prepares the sink selected by conf, the queue sink publishes to the broker of brokerConf
+func PrepareSink(conf Conf, brokerConf broker.Conf, dbAPI *db.DB) Sink {
+	switch conf.Type {
+	case "table":
+		return tableSink{dbAPI: dbAPI}
+	case "queue":
+		brokerConf.Topic = conf.Topic
+		return queueSink{publisher: broker.PreparePublisher(brokerConf)}
+	default:
+		return noSink{}
+	}
+}
+
+// Fail sends a log entry consumed from source that failed at stage to the sink, logging why it failed
+// Returns the error sending it, the entry is then lost unless it is consumed again
+func Fail(sink Sink, stage, source, entry, cid string, reason error) error {
+	log.Warning("Error at stage ", stage, " on log entry: ", entry, " ", reason)
+	f := model.FailedEntry{
+		Stage:    stage,
+		Reason:   reason.Error(),
+		Entry:    entry,
+		Cid:      cid,
+		Source:   source,
+		FailedAt: time.Now(),
+	}
+	err := sink.Send(f)
+	if err != nil {
+		log.Warning("Error dead-lettering log entry:", entry, err)
+	}
+	return err
+}
+
+// FailLookup sends the lookup of the cid that failed at stage to the sink, keyed by its cid rather than the log entry
+// that triggered it, which is written on its own. Re-driven to source, it is looked up again without writing a request
+func FailLookup(sink Sink, stage, source, cid string, reason error) error {
+	return Fail(sink, stage, source, LookupEntry(cid), cid, reason)
+}
+
+// LookupEntry returns the entry of a lookup of the cid, consumed as a request to look it up
+func LookupEntry(cid string) string {
+	return lookupPrefix + cid
+}
+
+// LookupCid returns the cid of the entry of a lookup, false if the entry is a log entry
+func LookupCid(entry string) (string, bool) {
+	if !strings.HasPrefix(entry, lookupPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(entry, lookupPrefix), true
+}
+
+// tableSink writes failed entries to the failed_entries table
+type tableSink struct {
+	dbAPI *db.DB
+}
+
+func (s tableSink) Send(f model.FailedEntry) error {
+	return s.dbAPI.WriteFailedEntryToDB(f)
+}
+
+// Close does nothing, the database is closed by its owner
+func (s tableSink) Close() error {
+	return nil
+}
+
+// queueSink publishes failed entries, as JSON, to a broker queue
+type queueSink struct {
+	publisher broker.Publisher
+}
+
+func (s queueSink) Send(f model.FailedEntry) error {
+	body, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return s.publisher.Publish(body)
+}
+
+func (s queueSink) Close() error {
+	return s.publisher.Close()
+}
+
+// noSink drops failed entries, which are only logged
+type noSink struct{}
+
+func (noSink) Send(model.FailedEntry) error {
+	return nil
+}
+
+func (noSink) Close() error {
+	return nil
+}
@@ -0,0 +1,182 @@
+package geo
+
+import (
+	"context"
+	"find_providers/pkg/model"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// Locator geolocates IP addresses with the MaxMind GeoLite2 City and ASN databases
+// The databases are reopened when their files change, see Reload
+type Locator struct {
+	cityPath string
+	asnPath  string
+
+	// reloadLock serializes reloads, lock guards the readers against lookups
+	reloadLock sync.Mutex
+	lock       sync.RWMutex
+	city       *geoip2.Reader
+	asn        *geoip2.Reader
+	cityMod    time.Time
+	asnMod     time.Time
+}
+
+// Open opens the GeoLite2 City and ASN databases at the given paths
+func Open(cityPath, asnPath string) (*Locator, error) {
+	l := &Locator{cityPath: cityPath, asnPath: asnPath}
+	var err error
+	if l.city, l.cityMod, err = openReader(cityPath); err != nil {
+		return nil, err
+	}
+	if l.asn, l.asnMod, err = openReader(asnPath); err != nil {
+		_ = l.city.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// openReader opens the database at path and returns it with the modification time of its file
+func openReader(path string) (*geoip2.Reader, time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	r, err := geoip2.Open(path)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("opening %v: %v", path, err)
+	}
+	return r, info.ModTime(), nil
+}
+
+// Lookup returns the location of the ip, with empty fields for what the databases do not know about it
+func (l *Locator) Lookup(ip string) (model.Location, error) {
+	var loc model.Location
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return loc, fmt.Errorf("%q is not a valid IP address", ip)
+	}
+
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	city, err := l.city.City(addr)
+	if err != nil {
+		return loc, err
+	}
+	loc.Continent = city.Continent.Code
+	loc.Country = city.Country.IsoCode
+	if n := len(city.Subdivisions); n > 0 {
+		// the most specific subdivision
+		loc.Region = city.Subdivisions[n-1].IsoCode
+	}
+	if city.Location.AccuracyRadius != 0 || city.Location.Latitude != 0 || city.Location.Longitude != 0 {
+		loc.Lat = strconv.FormatFloat(city.Location.Latitude, 'f', -1, 64)
+		loc.Long = strconv.FormatFloat(city.Location.Longitude, 'f', -1, 64)
+	}
+
+	asn, err := l.asn.ASN(addr)
+	if err != nil {
+		return loc, err
+	}
+	if asn.AutonomousSystemNumber != 0 {
+		loc.ASN = strconv.FormatUint(uint64(asn.AutonomousSystemNumber), 10)
+	}
+	loc.ASO = asn.AutonomousSystemOrganization
+	return loc, nil
+}
+
+// LocateEntry fills the location of the requester of a log entry
+func (l *Locator) LocateEntry(e *model.EntryStruct) error {
+	loc, err := l.Lookup(e.Ip)
+	if err != nil {
+		return err
+	}
+	e.Continent, e.Country, e.Region = loc.Continent, loc.Country, loc.Region
+	e.Lat, e.Long = loc.Lat, loc.Long
+	e.ASN, e.ASO = loc.ASN, loc.ASO
+	return nil
+}
+
+// Reload reopens the databases whose files were modified since they were opened
+// If a database cannot be reopened the previous one is kept. Returns whether any database was reloaded
+func (l *Locator) Reload() (bool, error) {
+	l.reloadLock.Lock()
+	defer l.reloadLock.Unlock()
+
+	city, cityMod, err := l.reopenIfModified(l.cityPath, l.cityMod)
+	if err != nil {
+		return false, err
+	}
+	asn, asnMod, err := l.reopenIfModified(l.asnPath, l.asnMod)
+	if err != nil {
+		if city != nil {
+			_ = city.Close()
+		}
+		return false, err
+	}
+	if city == nil && asn == nil {
+		return false, nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if city != nil {
+		_ = l.city.Close()
+		l.city, l.cityMod = city, cityMod
+	}
+	if asn != nil {
+		_ = l.asn.Close()
+		l.asn, l.asnMod = asn, asnMod
+	}
+	return true, nil
+}
+
+// reopenIfModified opens the database at path if its file was modified after mod, otherwise returns a nil reader
+func (l *Locator) reopenIfModified(path string, mod time.Time) (*geoip2.Reader, time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, mod, err
+	}
+	if info.ModTime().Equal(mod) {
+		return nil, mod, nil
+	}
+	return openReader(path)
+}
+
+// WatchReload calls Reload every interval until ctx is done
+func (l *Locator) WatchReload(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := l.Reload()
+			if err != nil {
+				log.Warning("Error reloading geolocation databases:", err)
+			} else if reloaded {
+				log.Infoln("Reloaded geolocation databases")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close closes the databases
+func (l *Locator) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	err := l.city.Close()
+	if asnErr := l.asn.Close(); err == nil {
+		err = asnErr
+	}
+	return err
+}
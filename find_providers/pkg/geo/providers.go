@@ -0,0 +1,120 @@
+package geo
+
+import (
+	"context"
+	"find_providers/pkg/maddr"
+	"find_providers/pkg/model"
+	"net"
+	"strings"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+	log "github.com/sirupsen/logrus"
+)
+
+// relayLocation is the location given to the addresses of providers reachable only through a relay
+var relayLocation = model.Location{Continent: "RL"}
+
+// dnsLookupTimeout bounds each lookup resolving a dns multiaddress, which is not located if it takes longer
+const dnsLookupTimeout = 5 * time.Second
+
+// maxDnsaddrDepth bounds how many nested dnsaddr records are followed to resolve a dnsaddr multiaddress
+const maxDnsaddrDepth = 4
+
+// the lookups resolving dns multiaddresses
+var (
+	lookupHost = net.DefaultResolver.LookupHost
+	lookupTXT  = net.DefaultResolver.LookupTXT
+)
+
+// LocateProviders sets the locations of the providers from their multiaddresses, one per located address
+// Loopback addresses are skipped and relayed addresses get the RL continent, as the parser service does.
+// The multiaddresses are classified here unless the find_providers service did, dns ones are resolved until ctx is done,
+// dnsaddr ones through the multiaddresses in their TXT records
+func (l *Locator) LocateProviders(ctx context.Context, providers []model.Provider) []model.Provider {
+	maddr.ClassifyProviders(providers)
+	for i := range providers {
+		providers[i].Locations = make([]model.Location, 0, len(providers[i].Addrs))
+		for _, addr := range providers[i].Addrs {
+			if addr.Kind == maddr.KindRelay {
+				providers[i].Locations = append(providers[i].Locations, relayLocation)
+				continue
+			}
+			ip := ipOf(ctx, addr, 0)
+			if ip == "" || ip == "127.0.0.1" || ip == "::1" {
+				continue
+			}
+			loc, err := l.Lookup(ip)
+			if err != nil {
+				log.Warning("Error fetching location of ", addr.MAddr, ": ", err)
+				continue
+			}
+			providers[i].Locations = append(providers[i].Locations, loc)
+		}
+	}
+	return providers
+}
+
+// ipOf returns the IP to locate a classified address at, resolving dns and dnsaddr ones, empty if it has none
+// depth counts the dnsaddr records followed to reach the address
+func ipOf(ctx context.Context, addr model.AddrInfo, depth int) string {
+	switch addr.Kind {
+	case maddr.KindIP4, maddr.KindIP6:
+		if addr.Scope != maddr.ScopeLoopback {
+			return addr.IP
+		}
+	case maddr.KindDNS:
+		m, err := ma.NewMultiaddr(addr.MAddr)
+		if err != nil {
+			return ""
+		}
+		if _, err := m.ValueForProtocol(ma.P_DNSADDR); err == nil {
+			peer, _ := m.ValueForProtocol(ma.P_P2P)
+			return resolveDnsaddr(ctx, addr.Host, peer, depth)
+		}
+		return resolve(ctx, addr.Host)
+	}
+	return ""
+}
+
+// resolve returns the first address of the host, empty if it cannot be resolved within dnsLookupTimeout
+func resolve(ctx context.Context, host string) string {
+	ctx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+	defer cancel()
+	ips, err := lookupHost(ctx, host)
+	if err != nil || len(ips) == 0 {
+		log.Debug("Error resolving ", host, ": ", err)
+		return ""
+	}
+	return ips[0]
+}
+
+// resolveDnsaddr returns the IP of the first multiaddress of the dnsaddr=<multiaddr> TXT records of _dnsaddr.<host>
+// that has one, following at most maxDnsaddrDepth nested dnsaddr records. Only the multiaddresses of the peer are
+// followed if it is set, as libp2p does
+func resolveDnsaddr(ctx context.Context, host, peer string, depth int) string {
+	if depth >= maxDnsaddrDepth {
+		log.Debug("Not resolving ", host, ": too many nested dnsaddr records")
+		return ""
+	}
+	lookupCtx, cancel := context.WithTimeout(ctx, dnsLookupTimeout)
+	defer cancel()
+	records, err := lookupTXT(lookupCtx, "_dnsaddr."+host)
+	if err != nil {
+		log.Debug("Error resolving dnsaddr ", host, ": ", err)
+		return ""
+	}
+	for _, record := range records {
+		if !strings.HasPrefix(record, "dnsaddr=") {
+			continue
+		}
+		s := strings.TrimPrefix(record, "dnsaddr=")
+		if peer != "" && !strings.HasSuffix(s, "/p2p/"+peer) && !strings.HasSuffix(s, "/ipfs/"+peer) {
+			continue
+		}
+		if ip := ipOf(ctx, maddr.Classify(s), depth+1); ip != "" {
+			return ip
+		}
+	}
+	return ""
+}
@@ -0,0 +1,79 @@
+package geo
+
+import (
+	"context"
+	"errors"
+	"find_providers/pkg/maddr"
+	"testing"
+)
+
+// peers of the bootstrap nodes
+const (
+	peer      = "QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN"
+	otherPeer = "QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa"
+)
+
+// records are the A and TXT records resolved in the tests, by name
+var records = map[string][]string{
+	"node.example.com": {"147.75.80.110"},
+	"_dnsaddr.bootstrap.example.com": {
+		"dnsaddr=/ip4/147.75.80.9/tcp/4001/p2p/" + otherPeer,
+		"dnsaddr=/ip4/147.75.80.10/tcp/4001/p2p/" + peer,
+	},
+	"_dnsaddr.nested.example.com": {
+		"dnsaddr=/dnsaddr/sv15.example.com/p2p/" + peer,
+	},
+	"_dnsaddr.sv15.example.com": {
+		// neither a loopback address nor an unknown one is located
+		"dnsaddr=/ip4/127.0.0.1/tcp/4001/p2p/" + peer,
+		"dnsaddr=/unknown/p2p/" + peer,
+		"dnsaddr=/dns4/node.example.com/tcp/4001/p2p/" + peer,
+	},
+	"_dnsaddr.loop.example.com": {
+		"dnsaddr=/dnsaddr/loop.example.com",
+	},
+	"_dnsaddr.other.example.com": {
+		"not a dnsaddr record",
+		"dnsaddr=/ip6/2604:1380:1000:6000::1/tcp/4001",
+	},
+}
+
+// lookup resolves the names of records
+func lookup(_ context.Context, name string) ([]string, error) {
+	if r, ok := records[name]; ok {
+		return r, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func TestIpOf(t *testing.T) {
+	defer func(host, txt func(context.Context, string) ([]string, error)) {
+		lookupHost, lookupTXT = host, txt
+	}(lookupHost, lookupTXT)
+	lookupHost, lookupTXT = lookup, lookup
+
+	for _, c := range []struct {
+		name, maddr, ip string
+	}{
+		{name: "ip4", maddr: "/ip4/147.75.80.110/tcp/4001", ip: "147.75.80.110"},
+		{name: "ip6", maddr: "/ip6/2604:1380:1000:6000::1/tcp/4001", ip: "2604:1380:1000:6000::1"},
+		{name: "loopback", maddr: "/ip4/127.0.0.1/tcp/4001", ip: ""},
+		{name: "dns", maddr: "/dns4/node.example.com/tcp/4001", ip: "147.75.80.110"},
+		{name: "unresolved dns", maddr: "/dns4/unknown.example.com/tcp/4001", ip: ""},
+		{name: "dnsaddr of the peer", maddr: "/dnsaddr/bootstrap.example.com/p2p/" + peer, ip: "147.75.80.10"},
+		{name: "dnsaddr of another peer", maddr: "/dnsaddr/bootstrap.example.com/p2p/" + otherPeer, ip: "147.75.80.9"},
+		{name: "dnsaddr without peer", maddr: "/dnsaddr/bootstrap.example.com", ip: "147.75.80.9"},
+		{name: "dnsaddr of an unknown peer", maddr: "/dnsaddr/bootstrap.example.com/p2p/QmcZf59bWwK5XFi76CZX8cbJ4BhTzzA3gU1ZjYZcYW3dwt", ip: ""},
+		{name: "nested dnsaddr", maddr: "/dnsaddr/nested.example.com/p2p/" + peer, ip: "147.75.80.110"},
+		{name: "dnsaddr loop", maddr: "/dnsaddr/loop.example.com", ip: ""},
+		{name: "dnsaddr skips other records", maddr: "/dnsaddr/other.example.com", ip: "2604:1380:1000:6000::1"},
+		// the A records of a dnsaddr host are not its addresses
+		{name: "dnsaddr without txt records", maddr: "/dnsaddr/node.example.com", ip: ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if ip := ipOf(context.Background(), maddr.Classify(c.maddr), 0); ip != c.ip {
+				t.Fatalf("got %q, expected %q", ip, c.ip)
+			}
+		})
+	}
+}
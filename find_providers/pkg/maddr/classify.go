@@ -0,0 +1,135 @@
+package maddr
+
+import (
+	"find_providers/pkg/model"
+
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/multiformats/go-multibase"
+)
+
+// kinds of multiaddress
+const (
+	KindIP4     = "ip4"
+	KindIP6     = "ip6"
+	KindDNS     = "dns"
+	KindRelay   = "relay"
+	KindUnknown = "unknown"
+)
+
+// scopes of the IP of a multiaddress
+const (
+	ScopePublic   = "public"
+	ScopePrivate  = "private"
+	ScopeLoopback = "loopback"
+)
+
+// transports names the protocols that identify the transport of a multiaddress, from the least to the most specific
+var transports = map[string]int{
+	"tcp":               1,
+	"udp":               1,
+	"quic":              2,
+	"quic-v1":           2,
+	"ws":                3,
+	"wss":               3,
+	"webtransport":      3,
+	"p2p-webrtc-direct": 3,
+	"webrtc-direct":     3,
+	"webrtc":            3,
+}
+
+// newer protocols, unknown to the go-multiaddr version we depend on, are registered so their addresses parse
+func init() {
+	certhash := ma.NewTranscoderFromFunctions(func(s string) ([]byte, error) {
+		_, b, err := multibase.Decode(s)
+		return b, err
+	}, func(b []byte) (string, error) {
+		return multibase.Encode(multibase.Base64url, b)
+	}, nil)
+	for _, p := range []ma.Protocol{
+		{Name: "quic-v1", Code: 0x01cd, VCode: ma.CodeToVarint(0x01cd)},
+		{Name: "webtransport", Code: 0x01d1, VCode: ma.CodeToVarint(0x01d1)},
+		{Name: "certhash", Code: 0x01d2, VCode: ma.CodeToVarint(0x01d2), Size: ma.LengthPrefixedVarSize, Transcoder: certhash},
+		{Name: "webrtc-direct", Code: 0x0118, VCode: ma.CodeToVarint(0x0118)},
+		{Name: "webrtc", Code: 0x0119, VCode: ma.CodeToVarint(0x0119)},
+		{Name: "sni", Code: 0x01c1, VCode: ma.CodeToVarint(0x01c1), Size: ma.LengthPrefixedVarSize, Transcoder: ma.TranscoderDns},
+	} {
+		if ma.ProtocolWithName(p.Name).Code == 0 {
+			_ = ma.AddProtocol(p)
+		}
+	}
+}
+
+// Classify tells what kind of multiaddress s is, where its IP is routable and which transport it uses
+// Relayed addresses are classified by the relay peer, and the transport used to reach the relay
+func Classify(s string) model.AddrInfo {
+	info := model.AddrInfo{MAddr: s, Kind: KindUnknown}
+	m, err := ma.NewMultiaddr(s)
+	if err != nil {
+		return info
+	}
+
+	lastPeer := ""
+	transport := 0
+	tls := false
+	ma.ForEach(m, func(c ma.Component) bool {
+		name := c.Protocol().Name
+		switch c.Protocol().Code {
+		case ma.P_IP4, ma.P_IP6:
+			info.Kind = name
+			info.IP = c.Value()
+			info.Scope = scopeOf(&c)
+		case ma.P_DNS, ma.P_DNS4, ma.P_DNS6, ma.P_DNSADDR:
+			info.Kind = KindDNS
+			info.Host = c.Value()
+		case ma.P_P2P:
+			lastPeer = c.Value()
+		case ma.P_CIRCUIT:
+			info.Kind = KindRelay
+			info.RelayPeer = lastPeer
+			// what follows describes the relayed peer, not how it is reached
+			return false
+		}
+		if name == "tls" {
+			tls = true
+		}
+		if rank, ok := transports[name]; ok && rank >= transport {
+			info.Transport, transport = name, rank
+			if name == "ws" && tls {
+				// /tls/ws is the current form of /wss
+				info.Transport = "wss"
+			}
+		}
+		return true
+	})
+	return info
+}
+
+// scopeOf tells where the IP of the component is routable
+func scopeOf(c ma.Multiaddr) string {
+	switch {
+	case manet.IsIPLoopback(c):
+		return ScopeLoopback
+	case manet.IsPublicAddr(c):
+		return ScopePublic
+	default:
+		return ScopePrivate
+	}
+}
+
+// ClassifyProvider classifies every multiaddress of the provider
+func ClassifyProvider(p *model.Provider) {
+	p.Addrs = make([]model.AddrInfo, len(p.MAddrs))
+	for i, m := range p.MAddrs {
+		p.Addrs[i] = Classify(m)
+	}
+}
+
+// ClassifyProviders classifies the multiaddresses of the providers that were not classified yet
+func ClassifyProviders(providers []model.Provider) {
+	for i := range providers {
+		if len(providers[i].Addrs) != len(providers[i].MAddrs) {
+			ClassifyProvider(&providers[i])
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package maddr
+
+import (
+	"find_providers/pkg/model"
+	"testing"
+)
+
+// peers of the bootstrap nodes
+const (
+	relayPeer  = "QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN"
+	targetPeer = "QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa"
+	certhash   = "uEiAkH5a4DPGKUuOBjYw0CgwjvcJCJMD2K_1aluKR_tpevQ"
+)
+
+func TestClassify(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		maddr string
+		info  model.AddrInfo
+	}{
+		{
+			name:  "public ip4",
+			maddr: "/ip4/147.75.80.110/tcp/4001",
+			info:  model.AddrInfo{Kind: KindIP4, Scope: ScopePublic, IP: "147.75.80.110", Transport: "tcp"},
+		},
+		{
+			name:  "private ip4",
+			maddr: "/ip4/192.168.1.2/udp/4001/quic",
+			info:  model.AddrInfo{Kind: KindIP4, Scope: ScopePrivate, IP: "192.168.1.2", Transport: "quic"},
+		},
+		{
+			name:  "loopback ip4",
+			maddr: "/ip4/127.0.0.1/tcp/4001",
+			info:  model.AddrInfo{Kind: KindIP4, Scope: ScopeLoopback, IP: "127.0.0.1", Transport: "tcp"},
+		},
+		{
+			name:  "public ip6",
+			maddr: "/ip6/2604:1380:1000:6000::1/udp/4001/quic-v1",
+			info:  model.AddrInfo{Kind: KindIP6, Scope: ScopePublic, IP: "2604:1380:1000:6000::1", Transport: "quic-v1"},
+		},
+		{
+			name:  "link-local ip6",
+			maddr: "/ip6/fe80::1/tcp/4001",
+			info:  model.AddrInfo{Kind: KindIP6, Scope: ScopePrivate, IP: "fe80::1", Transport: "tcp"},
+		},
+		{
+			name:  "unique local ip6",
+			maddr: "/ip6/fd00::1/tcp/4001",
+			info:  model.AddrInfo{Kind: KindIP6, Scope: ScopePrivate, IP: "fd00::1", Transport: "tcp"},
+		},
+		{
+			name:  "loopback ip6",
+			maddr: "/ip6/::1/tcp/4001",
+			info:  model.AddrInfo{Kind: KindIP6, Scope: ScopeLoopback, IP: "::1", Transport: "tcp"},
+		},
+		{
+			name:  "peer id",
+			maddr: "/ip4/147.75.80.110/tcp/4001/p2p/" + targetPeer,
+			info:  model.AddrInfo{Kind: KindIP4, Scope: ScopePublic, IP: "147.75.80.110", Transport: "tcp"},
+		},
+		{
+			name:  "dns",
+			maddr: "/dns/node.example.com/tcp/4001",
+			info:  model.AddrInfo{Kind: KindDNS, Host: "node.example.com", Transport: "tcp"},
+		},
+		{
+			name:  "dns4 wss",
+			maddr: "/dns4/node.example.com/tcp/443/wss",
+			info:  model.AddrInfo{Kind: KindDNS, Host: "node.example.com", Transport: "wss"},
+		},
+		{
+			name:  "dns6 tls ws",
+			maddr: "/dns6/node.example.com/tcp/443/tls/ws",
+			info:  model.AddrInfo{Kind: KindDNS, Host: "node.example.com", Transport: "wss"},
+		},
+		{
+			name:  "dnsaddr",
+			maddr: "/dnsaddr/bootstrap.libp2p.io/p2p/" + relayPeer,
+			info:  model.AddrInfo{Kind: KindDNS, Host: "bootstrap.libp2p.io"},
+		},
+		{
+			name:  "ws",
+			maddr: "/ip4/147.75.80.110/tcp/4002/ws",
+			info:  model.AddrInfo{Kind: KindIP4, Scope: ScopePublic, IP: "147.75.80.110", Transport: "ws"},
+		},
+		{
+			name:  "tls sni ws",
+			maddr: "/ip4/147.75.80.110/tcp/443/tls/sni/node.example.com/ws",
+			info:  model.AddrInfo{Kind: KindIP4, Scope: ScopePublic, IP: "147.75.80.110", Transport: "wss"},
+		},
+		{
+			name:  "webtransport",
+			maddr: "/ip4/147.75.80.110/udp/4001/quic-v1/webtransport/certhash/" + certhash + "/certhash/" + certhash,
+			info:  model.AddrInfo{Kind: KindIP4, Scope: ScopePublic, IP: "147.75.80.110", Transport: "webtransport"},
+		},
+		{
+			name:  "webrtc-direct",
+			maddr: "/ip4/147.75.80.110/udp/4001/webrtc-direct/certhash/" + certhash,
+			info:  model.AddrInfo{Kind: KindIP4, Scope: ScopePublic, IP: "147.75.80.110", Transport: "webrtc-direct"},
+		},
+		{
+			name:  "relay",
+			maddr: "/ip4/147.75.80.110/tcp/4001/p2p/" + relayPeer + "/p2p-circuit/p2p/" + targetPeer,
+			info:  model.AddrInfo{Kind: KindRelay, Scope: ScopePublic, IP: "147.75.80.110", RelayPeer: relayPeer, Transport: "tcp"},
+		},
+		{
+			// what follows the circuit describes the relayed peer, not how it is reached
+			name:  "relay over quic-v1",
+			maddr: "/ip4/147.75.80.110/udp/4001/quic-v1/p2p/" + relayPeer + "/p2p-circuit/webrtc/p2p/" + targetPeer,
+			info:  model.AddrInfo{Kind: KindRelay, Scope: ScopePublic, IP: "147.75.80.110", RelayPeer: relayPeer, Transport: "quic-v1"},
+		},
+		{
+			name:  "relay by dns",
+			maddr: "/dns4/relay.example.com/tcp/443/wss/p2p/" + relayPeer + "/p2p-circuit",
+			info:  model.AddrInfo{Kind: KindRelay, Host: "relay.example.com", RelayPeer: relayPeer, Transport: "wss"},
+		},
+		{
+			name:  "not a multiaddress",
+			maddr: "147.75.80.110:4001",
+			info:  model.AddrInfo{Kind: KindUnknown},
+		},
+		{
+			name:  "unknown protocol",
+			maddr: "/ip4/147.75.80.110/tcp/4001/unknown",
+			info:  model.AddrInfo{Kind: KindUnknown},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			c.info.MAddr = c.maddr
+			if info := Classify(c.maddr); info != c.info {
+				t.Fatalf("got %+v, expected %+v", info, c.info)
+			}
+		})
+	}
+}
+
+func TestClassifyProviders(t *testing.T) {
+	providers := []model.Provider{
+		{MAddrs: []string{"/ip4/147.75.80.110/tcp/4001", "/ip6/::1/tcp/4001"}},
+		// already classified
+		{MAddrs: []string{"/ip4/147.75.80.110/tcp/4001"}, Addrs: []model.AddrInfo{{MAddr: "/ip4/147.75.80.110/tcp/4001", Kind: "kept"}}},
+	}
+	ClassifyProviders(providers)
+	if len(providers[0].Addrs) != 2 || providers[0].Addrs[0].Kind != KindIP4 || providers[0].Addrs[1].Scope != ScopeLoopback {
+		t.Fatalf("got %+v", providers[0].Addrs)
+	}
+	if providers[1].Addrs[0].Kind != "kept" {
+		t.Fatalf("classified again %+v", providers[1].Addrs)
+	}
+}
@@ -0,0 +1,17 @@
+package model
+
+import "time"
+
+// FailedEntry is a log entry that failed to be processed, kept with why and where it failed to be re-driven later
+type FailedEntry struct {
+	Id int64 `json:"id,omitempty"`
+	// Stage is the stage of the pipeline the entry failed at
+	Stage  string `json:"stage"`
+	Reason string `json:"reason"`
+	// Entry is the log entry as it was consumed from the broker, or for the lookups failed, the lookup of Cid
+	Entry string `json:"entry"`
+	Cid   string `json:"cid,omitempty"`
+	// Source is the broker topic the entry was consumed from, and is re-driven to
+	Source   string    `json:"source"`
+	FailedAt time.Time `json:"failed_at"`
+}
@@ -0,0 +1,21 @@
+package model
+
+import "time"
+
+// Lookup is the outcome of a lookup of the providers of a cid, whether it found providers, none or failed
+type Lookup struct {
+	Cid       string
+	StartedAt time.Time
+	EndedAt   time.Time
+	Providers int
+	// ErrorClass is empty if the lookup succeeded, see service.ErrorClass
+	ErrorClass string
+	Error      string
+	// Source is what made the lookup: the controller, or the find_providers logs read by the writer
+	Source string
+}
+
+// Duration returns how long the lookup took
+func (l Lookup) Duration() time.Duration {
+	return l.EndedAt.Sub(l.StartedAt)
+}
@@ -15,9 +15,24 @@ type Location struct {
 	Region    string `json:"region"`
 }
 
+// AddrInfo is the classification of a multiaddress of a provider
+type AddrInfo struct {
+	MAddr string `json:"maddr"`
+	// Kind is ip4, ip6, dns, relay or unknown
+	Kind string `json:"kind"`
+	// Scope is public, private or loopback, for ip4 and ip6 addresses
+	Scope     string `json:"scope,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	Host      string `json:"host,omitempty"`
+	RelayPeer string `json:"relayPeer,omitempty"`
+	// Transport is the most specific transport protocol, such as tcp, quic-v1, webtransport or ws
+	Transport string `json:"transport,omitempty"`
+}
+
 type Provider struct {
 	PeerId    string     `json:"peerId"`
 	MAddrs    []string   `json:"maddrs"`
+	Addrs     []AddrInfo `json:"addrs,omitempty"`
 	Locations []Location `json:"locations"`
 }
 
@@ -0,0 +1,216 @@
+package parser
+
+import (
+	"errors"
+	"find_providers/pkg/geo"
+	"find_providers/pkg/model"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	cid2 "github.com/ipfs/go-cid"
+)
+
+// ErrNotGet is returned for log entries that are not remote GET requests
+var ErrNotGet = errors.New("log entry is not a valid GET")
+
+// ErrNoCid is returned for log entries whose request does not refer to a cid
+var ErrNoCid = errors.New("log entry has no cid")
+
+// timeLayouts are the formats of the nginx $time_iso8601 and $time_local variables
+var timeLayouts = []string{time.RFC3339, "02/Jan/2006:15:04:05 -0700"}
+
+// cidPattern matches the cids embedded anywhere in a host and target, as the parser service does
+var cidPattern = regexp.MustCompile(`(?:Qm|baf)\w+`)
+
+// ParseEntry parses a gateway log entry and extracts the cid it requests
+// Only remote GET requests referring to a cid are accepted, the others return ErrNotGet or ErrNoCid
+func ParseEntry(line string) (model.EntryStruct, error) {
+	e, err := ParseLogEntry(line)
+	if err != nil {
+		return e, err
+	}
+	if e.Op != "GET" || e.Ip == "127.0.0.1" || e.Ip == "::1" {
+		return e, ErrNotGet
+	}
+	cid, ok := ExtractCid(e.HttpHost, e.Target)
+	if !ok {
+		return e, ErrNoCid
+	}
+	e.Cid = cid
+	return e, nil
+}
+
+// ParseLogEntry parses a gateway log entry, without filtering it nor extracting its cid
+//
+// Expected format:
+// 199.83.232.50 - - [2022-03-21T00:00:58+00:00] "GET /ipfs/QmPvt7yHLGpVhd4jVFX6reEZZ34fQRepQ1a1QTsZQBH1hJ/KittyCat3621.png HTTP/1.1" 200 50470 120 12.823 12.820 12.820 MISS "-" "-" *.i.ipfs.io ipfs.io https
+// <ip> <x> <y> <time> <request> <status> <body_bytes> <req_lenght> <request_time> <upstream_response_time> <upstream_header_time> <upstream_cache_status> <http_refer> <http_user_agent> <server_name> <http_host> <scheme>
+func ParseLogEntry(line string) (model.EntryStruct, error) {
+	var e model.EntryStruct
+	tokens, err := tokenize(strings.TrimSpace(line))
+	if err != nil {
+		return e, err
+	}
+	// ip, two ignored fields, time and request, then status, body bytes, request length and request time
+	if len(tokens) < 9 {
+		return e, fmt.Errorf("cannot parse log entry: expected at least 9 fields, got %d", len(tokens))
+	}
+
+	e.Ip = tokens[0]
+	e.Time, err = parseTime(tokens[3])
+	if err != nil {
+		return e, fmt.Errorf("cannot parse log entry: %v", err)
+	}
+	// as the parser service, a request with spaces in its target keeps its first 3 tokens
+	request := strings.Split(tokens[4], " ")
+	if len(request) < 3 {
+		return e, fmt.Errorf("cannot parse log entry: malformed request %q", tokens[4])
+	}
+	e.Op, e.Target, e.Http = request[0], request[1], request[2]
+	e.Status = tokens[5]
+	e.BodyBytes = tokens[6]
+	e.RequestLength = tokens[7]
+	e.RequestTime = tokens[8]
+
+	i := 9
+	e.UpstreamResponseTime, i = upstreamTimes(tokens, i)
+	e.UpstreamHeaderTime, i = upstreamTimes(tokens, i)
+	// cache status, referer, user agent, server name and http host
+	if len(tokens)-i < 5 {
+		return e, errors.New("cannot parse log entry: missing fields after the upstream times")
+	}
+	e.Cache = tokens[i]
+	e.HttpRefer = tokens[i+1]
+	e.HttpUserAgent = tokens[i+2]
+	if len(tokens)-i == 5 {
+		// some gateways do not log the server name
+		e.HttpHost, e.Scheme = tokens[i+3], tokens[i+4]
+	} else {
+		e.ServerName, e.HttpHost, e.Scheme = tokens[i+3], tokens[i+4], tokens[i+5]
+	}
+	return e, nil
+}
+
+// ExtractCid extracts the cid requested by a gateway request, from either the path (/ipfs/<cid>)
+// or the subdomain (<cid>.ipfs.host) form, falling back to the first cid-looking string that decodes as a cid.
+// The parser service takes the first Qm and otherwise baf string of the host and target instead, so both differ when
+// a cid v0 follows a cid v1, as in /ipfs/<cid v1>/<cid v0>, or when the first string found is not a cid
+func ExtractCid(httpHost, target string) (string, bool) {
+	path := target
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	segments := strings.Split(path, "/")
+	for i := 0; i+1 < len(segments); i++ {
+		if segments[i] == "ipfs" && isCid(segments[i+1]) {
+			return segments[i+1], true
+		}
+	}
+
+	host := httpHost
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	labels := strings.Split(host, ".")
+	if len(labels) > 2 && labels[1] == "ipfs" && isCid(labels[0]) {
+		return labels[0], true
+	}
+
+	for _, candidate := range cidPattern.FindAllString(httpHost+target, -1) {
+		if isCid(candidate) {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// isCid checks if s decodes as a cid
+func isCid(s string) bool {
+	_, err := cid2.Decode(s)
+	return err == nil
+}
+
+// tokenize splits a log entry on spaces, keeping "quoted" and [bracketed] fields whole and without delimiters
+func tokenize(line string) ([]string, error) {
+	tokens := make([]string, 0, 20)
+	for len(line) > 0 {
+		if line[0] == ' ' {
+			line = line[1:]
+			continue
+		}
+		var end byte
+		switch line[0] {
+		case '"':
+			end = '"'
+		case '[':
+			end = ']'
+		}
+		if end != 0 {
+			j := strings.IndexByte(line[1:], end)
+			if j < 0 {
+				return nil, fmt.Errorf("cannot parse log entry: unterminated %c", line[0])
+			}
+			tokens = append(tokens, line[1:j+1])
+			line = line[j+2:]
+			continue
+		}
+		j := strings.IndexByte(line, ' ')
+		if j < 0 {
+			j = len(line)
+		}
+		tokens = append(tokens, line[:j])
+		line = line[j:]
+	}
+	return tokens, nil
+}
+
+// upstreamTimes reads an upstream time variable starting at tokens[i], which holds one value per upstream
+// attempt separated by ", ", and returns its values and the index of the following token
+func upstreamTimes(tokens []string, i int) ([]string, int) {
+	times := make([]string, 0, 1)
+	for ; i < len(tokens); i++ {
+		t := strings.TrimSuffix(tokens[i], ",")
+		times = append(times, t)
+		if t == tokens[i] {
+			return times, i + 1
+		}
+	}
+	return times, i
+}
+
+// parseTime parses the time of a log entry in any of the timeLayouts
+func parseTime(s string) (time.Time, error) {
+	var err error
+	for _, layout := range timeLayouts {
+		var t time.Time
+		if t, err = time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// EntryParser parses gateway log entries and geolocates their requesters in-process
+type EntryParser struct {
+	locator *geo.Locator
+}
+
+// NewEntryParser creates a parser geolocating requesters with the locator
+func NewEntryParser(locator *geo.Locator) *EntryParser {
+	return &EntryParser{locator: locator}
+}
+
+// Parse parses a gateway log entry as ParseEntry does and fills the location of its requester
+func (p *EntryParser) Parse(line string) (model.EntryStruct, error) {
+	e, err := ParseEntry(line)
+	if err != nil {
+		return e, err
+	}
+	if err := p.locator.LocateEntry(&e); err != nil {
+		return e, fmt.Errorf("cannot locate requester: %v", err)
+	}
+	return e, nil
+}
@@ -0,0 +1,124 @@
+package parser
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cids found in sample gateway logs
+const (
+	cidV0 = "QmPvt7yHLGpVhd4jVFX6reEZZ34fQRepQ1a1QTsZQBH1hJ"
+	cidV1 = "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi"
+)
+
+// fixture is what the parser service makes of a gateway log entry, generated by testdata/generate.py
+type fixture struct {
+	Name     string `json:"name"`
+	LogEntry string `json:"log_entry"`
+	// Result is ok, not_get, no_cid or parse, as the parser service answers with the entry or one of its errors
+	Result string                 `json:"result"`
+	Entry  map[string]interface{} `json:"entry"`
+}
+
+// difference is how the native parser knowingly parses a log entry differently than the parser service
+type difference struct {
+	// result replaces the result of the parser service, if set
+	result string
+	// fields replace the fields of the entry of the parser service
+	fields map[string]interface{}
+}
+
+var differences = map[string]difference{
+	// the parser service takes the first Qm string and otherwise the first baf one, the native parser the cid of the
+	// path first, and skips the strings that do not decode as cids
+	"cid v0 below a cid v1": {fields: map[string]interface{}{"cid": cidV1}},
+	"not a cid first":       {fields: map[string]interface{}{"cid": cidV1}},
+	"not a cid":             {result: "no_cid", fields: map[string]interface{}{"cid": ""}},
+	// the parser service assumes the entries without a server name were logged by the joaoleitao.org gateway
+	"no server name": {fields: map[string]interface{}{"server_name": ""}},
+	// the parser service splits the $time_local time on its space, shifting the fields that follow
+	"local time": {fields: map[string]interface{}{
+		"time":                   "2022-03-21T00:00:58Z",
+		"status":                 "200",
+		"body_bytes":             "50470",
+		"request_length":         "120",
+		"request_time":           "12.823",
+		"upstream_response_time": []interface{}{"12.820"},
+		"upstream_header_time":   []interface{}{"12.820"},
+		"cache":                  "MISS",
+		"server_name":            "*.i.ipfs.io",
+		"http_host":              "ipfs.io",
+		"scheme":                 "https",
+	}},
+}
+
+func TestParseEntryAsTheParserService(t *testing.T) {
+	data, err := os.ReadFile("testdata/gateway.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixtures []fixture
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range fixtures {
+		t.Run(f.Name, func(t *testing.T) {
+			expected, expectedFields := f.Result, normalize(f.Entry)
+			if d, ok := differences[f.Name]; ok {
+				if d.result != "" {
+					expected = d.result
+				}
+				for k, v := range d.fields {
+					expectedFields[k] = v
+				}
+			}
+
+			e, err := ParseEntry(f.LogEntry)
+			result := "ok"
+			switch {
+			case errors.Is(err, ErrNotGet):
+				result = "not_get"
+			case errors.Is(err, ErrNoCid):
+				result = "no_cid"
+			case err != nil:
+				result = "parse"
+			}
+			if result != expected {
+				t.Fatalf("got %v (%v), expected %v", result, err, expected)
+			}
+			if result == "parse" {
+				return
+			}
+
+			var fields map[string]interface{}
+			data, _ := json.Marshal(e)
+			_ = json.Unmarshal(data, &fields)
+			fields = normalize(fields)
+			for k, v := range expectedFields {
+				if !reflect.DeepEqual(fields[k], v) {
+					t.Errorf("got %v %#v, expected %#v", k, fields[k], v)
+				}
+			}
+		})
+	}
+}
+
+// normalize returns the fields of an entry comparable whatever parsed it: with a cid, empty if there is none, and
+// the time, if it can be parsed, in RFC 3339 without brackets
+func normalize(fields map[string]interface{}) map[string]interface{} {
+	normalized := map[string]interface{}{"cid": ""}
+	for k, v := range fields {
+		normalized[k] = v
+	}
+	if s, ok := normalized["time"].(string); ok {
+		if t, err := parseTime(strings.Trim(s, "[]")); err == nil {
+			normalized["time"] = t.UTC().Format(time.RFC3339)
+		}
+	}
+	return normalized
+}
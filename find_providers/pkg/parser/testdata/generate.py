@@ -0,0 +1,63 @@
+"""Generates gateway.json, what the parser service makes of the gateway log entries of gateway.tsv, using
+scripts/parsing/gateway.py as scripts/parser_service.py does, without geolocating them. The native parser is tested
+against it.
+
+Run from anywhere: python3 find_providers/pkg/parser/testdata/generate.py
+"""
+import json
+import os
+import sys
+import types
+
+here = os.path.dirname(os.path.abspath(__file__))
+sys.path.insert(0, os.path.join(here, '..', '..', '..', '..', 'scripts', 'parsing'))
+
+try:
+    import pandas as pd
+except ImportError:
+    # parse_log_entry and extract_cid only need pd.NA
+    pd = types.ModuleType('pandas')
+    pd.NA = object()
+    pd.DataFrame = object
+    sys.modules['pandas'] = pd
+try:
+    import dateutil.parser
+except ImportError:
+    # extract_date is not used
+    dateutil = types.ModuleType('dateutil')
+    dateutil.parser = types.ModuleType('dateutil.parser')
+    sys.modules['dateutil'] = dateutil
+    sys.modules['dateutil.parser'] = dateutil.parser
+
+import gateway
+
+
+def parse(log_entry: str) -> dict:
+    """ Parses the log entry as the /parse endpoint of the parser service does, result is ok, not_get, no_cid or
+    parse, as it answers with the entry or one of its errors
+    """
+    try:
+        entry = gateway.parse_log_entry(log_entry)
+    except Exception as e:
+        return {'result': 'parse', 'error': repr(e)}
+    if entry['op'] != 'GET' or entry['ip'] == '127.0.0.1' or entry['ip'] == '::1':
+        return {'result': 'not_get', 'entry': entry}
+    cid = gateway.extract_cid(entry['http_host'], entry['target'])
+    if cid is pd.NA:
+        return {'result': 'no_cid', 'entry': entry}
+    entry['time'] = entry['time'].strip('][')
+    entry['cid'] = cid
+    return {'result': 'ok', 'entry': entry}
+
+
+fixtures = []
+with open(os.path.join(here, 'gateway.tsv')) as f:
+    for row in f:
+        if row.startswith('#'):
+            continue
+        name, log_entry = row.rstrip('\n').split('\t')
+        fixtures.append({'name': name, 'log_entry': log_entry, **parse(log_entry)})
+
+with open(os.path.join(here, 'gateway.json'), 'w') as f:
+    json.dump(fixtures, f, indent=2)
+    f.write('\n')
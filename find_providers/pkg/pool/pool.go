@@ -0,0 +1,119 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrClosed is returned when submitting to a closed pool
+var ErrClosed = errors.New("pool is closed")
+
+// Pool runs tasks on a fixed number of workers fed by a bounded queue
+// Submitting blocks while the queue is full, so a slow stage slows down the stages feeding it
+type Pool struct {
+	// accessed atomically, kept first for 64-bit alignment
+	queued    int64
+	active    int64
+	completed int64
+
+	name    string
+	workers int
+	tasks   chan func()
+	wg      sync.WaitGroup
+
+	closeLock sync.RWMutex
+	closed    bool
+}
+
+// Stats are the counters of a Pool
+type Stats struct {
+	Name      string
+	Workers   int
+	Queued    int64
+	Active    int64
+	Completed int64
+}
+
+// New creates a pool with the given number of workers and queue depth, and starts its workers
+func New(name string, workers, depth int) *Pool {
+	p := &Pool{
+		name:    name,
+		workers: workers,
+		tasks:   make(chan func(), depth),
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// work runs the tasks of the pool until it is closed and its queue is empty
+func (p *Pool) work() {
+	defer p.wg.Done()
+	for task := range p.tasks {
+		atomic.AddInt64(&p.queued, -1)
+		atomic.AddInt64(&p.active, 1)
+		task()
+		atomic.AddInt64(&p.active, -1)
+		atomic.AddInt64(&p.completed, 1)
+	}
+}
+
+// Submit queues the task, waiting while the queue is full
+// Returns ctx.Err() if ctx is done before there is room in the queue, or ErrClosed if the pool is closed
+func (p *Pool) Submit(ctx context.Context, task func()) error {
+	p.closeLock.RLock()
+	defer p.closeLock.RUnlock()
+	if p.closed {
+		return ErrClosed
+	}
+	atomic.AddInt64(&p.queued, 1)
+	select {
+	case p.tasks <- task:
+		return nil
+	case <-ctx.Done():
+		atomic.AddInt64(&p.queued, -1)
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting tasks, the workers exit once the queued tasks are done
+// Submit calls blocked on a full queue keep Close waiting until they return
+func (p *Pool) Close() {
+	p.closeLock.Lock()
+	defer p.closeLock.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.tasks)
+	}
+}
+
+// Wait waits until the pool is closed and all its tasks are done, or until ctx is done
+// Returns whether all the tasks are done
+func (p *Pool) Wait(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Stats returns the current counters of the pool
+func (p *Pool) Stats() Stats {
+	return Stats{
+		Name:      p.name,
+		Workers:   p.workers,
+		Queued:    atomic.LoadInt64(&p.queued),
+		Active:    atomic.LoadInt64(&p.active),
+		Completed: atomic.LoadInt64(&p.completed),
+	}
+}
@@ -0,0 +1,71 @@
+package reqid
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"find_providers/pkg/model"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// DefaultFields are the fields of an entry fingerprinted by default, those the request ids were always made of
+var DefaultFields = []string{"time", "ip", "cid", "body_bytes", "request_time", "request_length", "http_user_agent"}
+
+// encodings of request ids
+var encodings = map[string]func([]byte) string{
+	"hex": hex.EncodeToString,
+	"base32": func(b []byte) string {
+		return strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+	},
+}
+
+// fieldIndexes maps the json names of the fields of model.EntryStruct to their index
+var fieldIndexes = func() map[string]int {
+	t := reflect.TypeOf(model.EntryStruct{})
+	indexes := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		indexes[name] = i
+	}
+	return indexes
+}()
+
+// Generator generates the ids of requests from the fingerprint of some fields of their log entries
+// The id is the SHA-256 of the fields, formatted with %v and concatenated in order, encoded as hex or base32 text
+// With DefaultFields and hex encoding the ids are the hex encoding of the ids stored as bytes by earlier versions
+type Generator struct {
+	fields []int
+	encode func([]byte) string
+}
+
+// New creates a generator fingerprinting the named fields, named as in the json encoding of model.EntryStruct
+func New(fields []string, encoding string) (*Generator, error) {
+	encode, ok := encodings[encoding]
+	if !ok {
+		return nil, fmt.Errorf("unknown request id encoding %q, expected hex or base32", encoding)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no request id fields")
+	}
+	g := &Generator{encode: encode}
+	for _, f := range fields {
+		i, ok := fieldIndexes[f]
+		if !ok {
+			return nil, fmt.Errorf("unknown request id field %q", f)
+		}
+		g.fields = append(g.fields, i)
+	}
+	return g, nil
+}
+
+// Id returns the id of the request of the entry
+func (g *Generator) Id(e model.EntryStruct) string {
+	v := reflect.ValueOf(e)
+	h := sha256.New()
+	for _, i := range g.fields {
+		_, _ = fmt.Fprintf(h, "%v", v.Field(i).Interface())
+	}
+	return g.encode(h.Sum(nil))
+}
@@ -0,0 +1,95 @@
+package reqid
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"find_providers/pkg/model"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sampleEntry is a parsed gateway log entry
+var sampleEntry = model.EntryStruct{
+	Time:          time.Date(2022, 3, 21, 0, 0, 58, 0, time.UTC),
+	Ip:            "199.83.232.50",
+	Cid:           "QmPvt7yHLGpVhd4jVFX6reEZZ34fQRepQ1a1QTsZQBH1hJ",
+	BodyBytes:     "50470",
+	RequestTime:   "12.823",
+	RequestLength: "120",
+	HttpUserAgent: "Mozilla/5.0",
+	HttpHost:      "ipfs.io",
+	Status:        "200",
+}
+
+// sampleId is the id of sampleEntry with the default fields and hex encoding, the sha256sum of
+// "2022-03-21 00:00:58 +0000 UTC199.83.232.50QmPvt7yHLGpVhd4jVFX6reEZZ34fQRepQ1a1QTsZQBH1hJ5047012.823120Mozilla/5.0"
+const sampleId = "e794ee4950c92b944ec61b941c1bc8fc7fca035f9654817be445c587fd508994"
+
+// genReqId is the request id of earlier versions, stored as bytes in requests.req_id, as the req_id_text migration
+// expects the default fields to reproduce it
+func genReqId(e model.EntryStruct) string {
+	h := sha256.New()
+	h.Write([]byte(fmt.Sprintf("%v%v%v%v%v%v%v", e.Time, e.Ip, e.Cid, e.BodyBytes, e.RequestTime, e.RequestLength, e.HttpUserAgent)))
+	return string(h.Sum(nil))
+}
+
+func TestDefaultFieldsReproduceEarlierIds(t *testing.T) {
+	g, err := New(DefaultFields, "hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := g.Id(sampleEntry)
+	if expected := hex.EncodeToString([]byte(genReqId(sampleEntry))); id != expected {
+		t.Fatalf("got id %v, expected %v as earlier versions stored it", id, expected)
+	}
+	if id != sampleId {
+		t.Fatalf("got id %v, expected %v", id, sampleId)
+	}
+}
+
+func TestEncodings(t *testing.T) {
+	sum := []byte(genReqId(sampleEntry))
+	for encoding, expected := range map[string]string{
+		"hex":    hex.EncodeToString(sum),
+		"base32": strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(sum)),
+	} {
+		g, err := New(DefaultFields, encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id := g.Id(sampleEntry); id != expected {
+			t.Errorf("got %v id %v, expected %v", encoding, id, expected)
+		}
+	}
+	for _, encoding := range []string{"base64", "HEX", ""} {
+		if _, err := New(DefaultFields, encoding); err == nil {
+			t.Errorf("accepted unknown encoding %q", encoding)
+		}
+	}
+}
+
+func TestFields(t *testing.T) {
+	for _, fields := range [][]string{nil, {}, {"time", "unknown"}, {"Time"}} {
+		if _, err := New(fields, "hex"); err == nil {
+			t.Errorf("accepted fields %q", fields)
+		}
+	}
+
+	g, err := New([]string{"cid", "http_host", "status"}, "hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(sampleEntry.Cid + sampleEntry.HttpHost + sampleEntry.Status))
+	if id := g.Id(sampleEntry); id != hex.EncodeToString(sum[:]) {
+		t.Errorf("got id %v, expected the hash of the fields in order", id)
+	}
+	// fields outside of the fingerprint do not change the id
+	other := sampleEntry
+	other.Ip = "1.2.3.4"
+	if g.Id(other) != g.Id(sampleEntry) {
+		t.Error("the id changed with a field outside of the fingerprint")
+	}
+}
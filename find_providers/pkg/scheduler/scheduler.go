@@ -0,0 +1,287 @@
+package scheduler
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"sync"
+)
+
+// Scheduler orders pending lookups by the popularity of their cids
+// Popular cids, requested more than a threshold over the window, are looked up first, the most requested first.
+// The long tail of the other cids is looked up in arrival order, with a share of the lookups reserved for it so a
+// steady stream of popular cids does not starve it. A cid is pending at most once, more requests only raise its
+// popularity. Lookups of cids whose cached providers expired are scheduled the same way as first lookups
+type Scheduler struct {
+	lock sync.Mutex
+	// popular is a heap of the popular pending cids, tail a list of the long tail ones in arrival order
+	popular   popularHeap
+	tail      *list.List
+	pending   map[string]*item
+	threshold int
+	share     float64
+	capacity  int
+	seq       int64
+	closed    bool
+	// ready is signalled when lookups are pushed or the scheduler is closed, room when lookups are handed out
+	ready chan struct{}
+	room  chan struct{}
+
+	dispatched     int64
+	dispatchedTail int64
+	dropped        int64
+}
+
+// Stats are the counters of a Scheduler
+type Stats struct {
+	Popular int
+	Tail    int
+	// Dispatched counts the lookups handed out, DispatchedTail those of long tail cids
+	Dispatched     int64
+	DispatchedTail int64
+	// Dropped counts the lookups not scheduled because the scheduler was full
+	Dropped int64
+}
+
+// item is a pending lookup
+type item struct {
+	cid   string
+	count int
+	seq   int64
+	run   func()
+	// index in the popular heap, or the element in the tail list
+	index int
+	elem  *list.Element
+}
+
+// New creates a scheduler holding at most capacity pending lookups
+// Cids requested at most threshold times over the window are the long tail, which gets share of the lookups
+func New(capacity, threshold int, share float64) *Scheduler {
+	return &Scheduler{
+		tail:      list.New(),
+		pending:   make(map[string]*item),
+		threshold: threshold,
+		share:     share,
+		capacity:  capacity,
+		ready:     make(chan struct{}, 1),
+		room:      make(chan struct{}, 1),
+	}
+}
+
+// Push schedules run to look up the cid, requested count times over the window
+// If the cid is already pending its popularity is updated instead, and run is not scheduled.
+// When the scheduler is full, the oldest long tail lookup makes room for a popular one, otherwise run is dropped.
+// Returns whether run was scheduled, and the cid of the lookup dropped to make room for it, if any
+func (s *Scheduler) Push(cid string, count int, run func()) (bool, string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.push(cid, count, run)
+}
+
+// push schedules run as Push does, with the lock held
+func (s *Scheduler) push(cid string, count int, run func()) (bool, string) {
+	if it, ok := s.pending[cid]; ok {
+		s.update(it, count)
+		return false, ""
+	}
+	if s.closed {
+		s.dropped++
+		return false, ""
+	}
+
+	evicted := ""
+	if len(s.pending) >= s.capacity {
+		oldest := s.tail.Front()
+		if count <= s.threshold || oldest == nil {
+			s.dropped++
+			return false, ""
+		}
+		evicted = s.remove(oldest.Value.(*item))
+		s.dropped++
+	}
+
+	s.seq++
+	it := &item{cid: cid, count: count, seq: s.seq, run: run}
+	s.pending[cid] = it
+	if count > s.threshold {
+		heap.Push(&s.popular, it)
+	} else {
+		it.elem = s.tail.PushBack(it)
+	}
+	s.signal()
+	return true, evicted
+}
+
+// PushWait schedules run to look up the cid as Push does, but waits for room when the scheduler is full instead of
+// dropping a lookup. Returns whether run was scheduled, false if the cid was pending or the scheduler is closed, and
+// ctx.Err() if ctx is done before there is room
+func (s *Scheduler) PushWait(ctx context.Context, cid string, count int, run func()) (bool, error) {
+	for {
+		s.lock.Lock()
+		if _, ok := s.pending[cid]; ok || s.closed || len(s.pending) < s.capacity {
+			scheduled, _ := s.push(cid, count, run)
+			if s.closed || len(s.pending) < s.capacity {
+				// the other lookups waiting may go on too
+				s.signalRoom()
+			}
+			s.lock.Unlock()
+			return scheduled, nil
+		}
+		s.lock.Unlock()
+		select {
+		case <-s.room:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// Touch updates the popularity of the cid if its lookup is pending
+func (s *Scheduler) Touch(cid string, count int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if it, ok := s.pending[cid]; ok {
+		s.update(it, count)
+	}
+}
+
+// update sets the count of a pending lookup, moving it out of the long tail once it becomes popular
+func (s *Scheduler) update(it *item, count int) {
+	if count <= it.count {
+		return
+	}
+	it.count = count
+	switch {
+	case it.elem == nil:
+		heap.Fix(&s.popular, it.index)
+	case count > s.threshold:
+		s.tail.Remove(it.elem)
+		it.elem = nil
+		heap.Push(&s.popular, it)
+	}
+}
+
+// remove unschedules a pending lookup and returns its cid
+func (s *Scheduler) remove(it *item) string {
+	if it.elem != nil {
+		s.tail.Remove(it.elem)
+	} else {
+		heap.Remove(&s.popular, it.index)
+	}
+	delete(s.pending, it.cid)
+	return it.cid
+}
+
+// Next waits for the next lookup to run and returns it
+// Returns false once the scheduler is closed and empty, or if ctx is done
+func (s *Scheduler) Next(ctx context.Context) (func(), bool) {
+	for {
+		s.lock.Lock()
+		it := s.pick()
+		closed := s.closed
+		if it != nil {
+			s.remove(it)
+			s.dispatched++
+			if len(s.pending) > 0 {
+				s.signal()
+			}
+			s.signalRoom()
+		}
+		s.lock.Unlock()
+
+		if it != nil {
+			return it.run, true
+		}
+		if closed {
+			return nil, false
+		}
+		select {
+		case <-s.ready:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// pick chooses the next lookup: the most popular one, unless the long tail is behind its share
+func (s *Scheduler) pick() *item {
+	front := s.tail.Front()
+	if front != nil && (len(s.popular) == 0 || float64(s.dispatchedTail) < s.share*float64(s.dispatched+1)) {
+		s.dispatchedTail++
+		return front.Value.(*item)
+	}
+	if len(s.popular) > 0 {
+		return s.popular[0]
+	}
+	return nil
+}
+
+// signal wakes up Next
+func (s *Scheduler) signal() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// signalRoom wakes up PushWait
+func (s *Scheduler) signalRoom() {
+	select {
+	case s.room <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops accepting lookups, Next keeps handing out the pending ones until there are none left
+func (s *Scheduler) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	s.signal()
+	s.signalRoom()
+}
+
+// Stats returns the current counters of the scheduler
+func (s *Scheduler) Stats() Stats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return Stats{
+		Popular:        len(s.popular),
+		Tail:           s.tail.Len(),
+		Dispatched:     s.dispatched,
+		DispatchedTail: s.dispatchedTail,
+		Dropped:        s.dropped,
+	}
+}
+
+// popularHeap orders the popular lookups by count, the oldest first among equally popular ones
+type popularHeap []*item
+
+func (h popularHeap) Len() int { return len(h) }
+
+func (h popularHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count > h[j].count
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h popularHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *popularHeap) Push(x interface{}) {
+	it := x.(*item)
+	it.index = len(*h)
+	*h = append(*h, it)
+}
+
+func (h *popularHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return it
+}
@@ -0,0 +1,178 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// push is a lookup pushed to a scheduler
+type push struct {
+	cid   string
+	count int
+}
+
+// lookups pushes lookups recording the cids they look up
+type lookups struct {
+	s     *Scheduler
+	order []string
+}
+
+// push pushes a lookup of the cid and returns what Push returns
+func (l *lookups) push(cid string, count int) (bool, string) {
+	return l.s.Push(cid, count, func() { l.order = append(l.order, cid) })
+}
+
+// drain closes the scheduler and runs the lookups it hands out until it is empty
+func (l *lookups) drain() []string {
+	l.s.Close()
+	for {
+		run, ok := l.s.Next(context.Background())
+		if !ok {
+			return l.order
+		}
+		run()
+	}
+}
+
+func TestDispatchOrder(t *testing.T) {
+	pushes := []push{{"a", 1}, {"b", 5}, {"c", 3}, {"d", 1}, {"e", 3}}
+	for _, c := range []struct {
+		name  string
+		share float64
+		order []string
+	}{
+		{name: "popular first", share: 0, order: []string{"b", "c", "e", "a", "d"}},
+		{name: "half to the long tail", share: 0.5, order: []string{"a", "b", "d", "c", "e"}},
+		{name: "long tail first", share: 1, order: []string{"a", "d", "b", "c", "e"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			l := &lookups{s: New(10, 1, c.share)}
+			for _, p := range pushes {
+				if scheduled, _ := l.push(p.cid, p.count); !scheduled {
+					t.Fatalf("did not schedule %v", p.cid)
+				}
+			}
+			if order := l.drain(); !reflect.DeepEqual(order, c.order) {
+				t.Fatalf("looked up %v, expected %v", order, c.order)
+			}
+			if st := l.s.Stats(); st.Dispatched != int64(len(pushes)) || st.DispatchedTail != 2 {
+				t.Fatalf("got %+v, expected %v lookups dispatched, 2 of the long tail", st, len(pushes))
+			}
+		})
+	}
+}
+
+func TestEvictionWhenFull(t *testing.T) {
+	l := &lookups{s: New(2, 1, 0)}
+	for _, c := range []struct {
+		push
+		scheduled bool
+		evicted   string
+	}{
+		{push: push{"a", 1}, scheduled: true},
+		{push: push{"b", 1}, scheduled: true},
+		// a popular lookup makes room by evicting the oldest long tail one
+		{push: push{"c", 5}, scheduled: true, evicted: "a"},
+		// a long tail lookup is dropped
+		{push: push{"d", 1}},
+		{push: push{"e", 7}, scheduled: true, evicted: "b"},
+		// no long tail lookup is left to evict
+		{push: push{"f", 9}},
+		// a pending cid is not scheduled twice
+		{push: push{"c", 6}},
+	} {
+		scheduled, evicted := l.push(c.cid, c.count)
+		if scheduled != c.scheduled || evicted != c.evicted {
+			t.Fatalf("pushing %v got (%v, %q), expected (%v, %q)", c.cid, scheduled, evicted, c.scheduled, c.evicted)
+		}
+	}
+	if st := l.s.Stats(); st.Dropped != 4 || st.Popular != 2 || st.Tail != 0 {
+		t.Fatalf("got %+v, expected 4 lookups dropped and 2 popular ones pending", st)
+	}
+	if order := l.drain(); !reflect.DeepEqual(order, []string{"e", "c"}) {
+		t.Fatalf("looked up %v, expected [e c]", order)
+	}
+}
+
+func TestTouchPromotesToPopular(t *testing.T) {
+	l := &lookups{s: New(10, 1, 0)}
+	l.push("a", 1)
+	l.push("b", 3)
+	l.push("c", 1)
+	l.s.Touch("c", 4)
+	// pushing a pending cid updates its popularity too
+	l.push("a", 2)
+	// and never lowers it
+	l.s.Touch("b", 1)
+	if st := l.s.Stats(); st.Popular != 3 || st.Tail != 0 {
+		t.Fatalf("got %+v, expected every lookup to be popular", st)
+	}
+	if order := l.drain(); !reflect.DeepEqual(order, []string{"c", "b", "a"}) {
+		t.Fatalf("looked up %v, expected [c b a]", order)
+	}
+}
+
+func TestPushWait(t *testing.T) {
+	pushWait := func(s *Scheduler, ctx context.Context, cid string) chan error {
+		done := make(chan error, 1)
+		go func() {
+			scheduled, err := s.PushWait(ctx, cid, 1, func() {})
+			if err == nil && !scheduled {
+				err = errNotScheduled
+			}
+			done <- err
+		}()
+		return done
+	}
+	full := func() *Scheduler {
+		s := New(1, 1, 0)
+		s.Push("a", 1, func() {})
+		return s
+	}
+
+	t.Run("waits for room", func(t *testing.T) {
+		s := full()
+		done := pushWait(s, context.Background(), "b")
+		select {
+		case err := <-done:
+			t.Fatalf("returned %v while the scheduler was full", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if _, ok := s.Next(context.Background()); !ok {
+			t.Fatal("no lookup handed out")
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if st := s.Stats(); st.Dropped != 0 || st.Tail != 1 {
+			t.Fatalf("got %+v, expected the lookup to be pending", st)
+		}
+	})
+
+	t.Run("context done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := pushWait(full(), ctx, "b")
+		cancel()
+		if err := <-done; err != context.Canceled {
+			t.Fatalf("got %v, expected %v", err, context.Canceled)
+		}
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		s := full()
+		waiting := []chan error{pushWait(s, context.Background(), "b"), pushWait(s, context.Background(), "c")}
+		time.Sleep(50 * time.Millisecond)
+		s.Close()
+		for _, done := range waiting {
+			if err := <-done; err != errNotScheduled {
+				t.Fatalf("got %v, expected the lookup not to be scheduled", err)
+			}
+		}
+	})
+}
+
+// errNotScheduled is returned by the PushWait of TestPushWait when it did not schedule the lookup
+var errNotScheduled = errors.New("not scheduled")
@@ -0,0 +1,85 @@
+package scheduler
+
+import (
+	"sync"
+	"time"
+)
+
+// Window counts the requests of every cid over a sliding window
+// The window is split in buckets, the oldest bucket is forgotten as a whole when the window slides past it
+type Window struct {
+	lock      sync.Mutex
+	bucketLen time.Duration
+	buckets   []map[string]int
+	// current is the index of the bucket counting requests until currentEnd
+	current    int
+	currentEnd time.Time
+	totals     map[string]int
+}
+
+// NewWindow creates a window of the given length, split in the given number of buckets
+func NewWindow(length time.Duration, buckets int) *Window {
+	w := &Window{
+		bucketLen:  length / time.Duration(buckets),
+		buckets:    make([]map[string]int, buckets),
+		currentEnd: time.Now().Add(length / time.Duration(buckets)),
+		totals:     make(map[string]int),
+	}
+	for i := range w.buckets {
+		w.buckets[i] = make(map[string]int)
+	}
+	return w
+}
+
+// Add counts a request for the cid and returns its count over the window
+func (w *Window) Add(cid string) int {
+	return w.add(cid, time.Now())
+}
+
+// add counts a request for the cid made at now
+func (w *Window) add(cid string, now time.Time) int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.slide(now)
+	w.buckets[w.current][cid]++
+	w.totals[cid]++
+	return w.totals[cid]
+}
+
+// Count returns the count of the cid over the window
+func (w *Window) Count(cid string) int {
+	return w.count(cid, time.Now())
+}
+
+// count returns the count of the cid over the window ending at now
+func (w *Window) count(cid string, now time.Time) int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.slide(now)
+	return w.totals[cid]
+}
+
+// Len returns how many cids were requested over the window
+func (w *Window) Len() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.totals)
+}
+
+// slide forgets the buckets that fell out of the window by now
+func (w *Window) slide(now time.Time) {
+	for i := 0; i < len(w.buckets) && !now.Before(w.currentEnd); i++ {
+		w.current = (w.current + 1) % len(w.buckets)
+		for cid, n := range w.buckets[w.current] {
+			if w.totals[cid] -= n; w.totals[cid] <= 0 {
+				delete(w.totals, cid)
+			}
+		}
+		w.buckets[w.current] = make(map[string]int)
+		w.currentEnd = w.currentEnd.Add(w.bucketLen)
+	}
+	if now.After(w.currentEnd) {
+		// idle for longer than the window, every bucket is empty now
+		w.currentEnd = now.Add(w.bucketLen)
+	}
+}
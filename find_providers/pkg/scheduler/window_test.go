@@ -0,0 +1,70 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+// count is the count of a cid expected at a time after the start of a window
+type count struct {
+	at    time.Duration
+	count int
+}
+
+func TestWindowForgetsCounts(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		// requests are the times requests are counted at, after the start of the window
+		requests []time.Duration
+		counts   []count
+	}{
+		{
+			name:     "within the window",
+			requests: []time.Duration{0, 1500 * time.Millisecond, 3 * time.Second},
+			counts:   []count{{3500 * time.Millisecond, 3}, {3900 * time.Millisecond, 3}},
+		},
+		{
+			name:     "oldest bucket forgotten",
+			requests: []time.Duration{0, 1500 * time.Millisecond},
+			counts:   []count{{3900 * time.Millisecond, 2}, {4200 * time.Millisecond, 1}, {5500 * time.Millisecond, 0}},
+		},
+		{
+			name:     "idle for longer than the window",
+			requests: []time.Duration{0, 100 * time.Second},
+			counts:   []count{{100500 * time.Millisecond, 1}, {103500 * time.Millisecond, 1}, {104500 * time.Millisecond, 0}},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			// buckets of a second
+			w := NewWindow(4*time.Second, 4)
+			start := w.currentEnd.Add(-w.bucketLen)
+			for _, at := range c.requests {
+				w.add("a", start.Add(at))
+			}
+			for _, expected := range c.counts {
+				if n := w.count("a", start.Add(expected.at)); n != expected.count {
+					t.Fatalf("got count %v at %v, expected %v", n, expected.at, expected.count)
+				}
+				if expected.count == 0 && w.Len() != 0 {
+					t.Fatalf("got %v cids at %v, expected the window to forget them", w.Len(), expected.at)
+				}
+			}
+		})
+	}
+}
+
+func TestWindowAddReturnsTheCount(t *testing.T) {
+	w := NewWindow(4*time.Second, 4)
+	start := w.currentEnd.Add(-w.bucketLen)
+	for i, at := range []time.Duration{0, 500 * time.Millisecond, 2 * time.Second} {
+		if n := w.add("a", start.Add(at)); n != i+1 {
+			t.Fatalf("got count %v after %v requests", n, i+1)
+		}
+	}
+	if n := w.add("b", start.Add(2*time.Second)); n != 1 {
+		t.Fatalf("got count %v for another cid, expected 1", n)
+	}
+	if w.Len() != 2 {
+		t.Fatalf("got %v cids, expected 2", w.Len())
+	}
+}
@@ -0,0 +1,261 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without sending the request while the circuit breaker of a client is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// ErrDecode is returned when the answer of a service cannot be decoded
+var ErrDecode = errors.New("decoding answer")
+
+// ClientConf tunes the timeouts, retries and circuit breaker of a Client
+type ClientConf struct {
+	// Timeout bounds each attempt of a request, unless the request sets its own
+	Timeout time.Duration `yaml:"timeout" toml:"timeout"`
+	// Retries is how many times idempotent requests are retried, waiting an exponential backoff with jitter
+	// between BackoffBase and BackoffMax
+	Retries     int           `yaml:"retries" toml:"retries"`
+	BackoffBase time.Duration `yaml:"backoff_base" toml:"backoff_base"`
+	BackoffMax  time.Duration `yaml:"backoff_max" toml:"backoff_max"`
+	// the breaker opens after BreakerThreshold consecutive failures and lets a request through after BreakerCooldown
+	BreakerThreshold int           `yaml:"breaker_threshold" toml:"breaker_threshold"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown" toml:"breaker_cooldown"`
+}
+
+// Request is a request sent by a Client
+type Request struct {
+	Method      string
+	Url         string
+	ContentType string
+	Body        []byte
+	// Idempotent requests are retried on network errors and 5xx answers
+	Idempotent bool
+	// Timeout overrides the timeout of the client for this request
+	Timeout time.Duration
+}
+
+// Response is a response received by a Client, with its body already read
+type Response struct {
+	StatusCode int
+	Status     string
+	Body       []byte
+}
+
+// StatusError is returned when a service answers with a non 2xx status
+type StatusError struct {
+	StatusCode int
+	Status     string
+	// Message is the error reported by the service in a {"error": "..."} body, if any
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Status, e.Message)
+}
+
+// Client sends requests to a service, retrying and tripping a circuit breaker on failures
+// It is safe for concurrent use
+type Client struct {
+	name    string
+	conf    ClientConf
+	http    *http.Client
+	breaker breaker
+}
+
+// NewClient creates a client for the named service
+func NewClient(name string, conf ClientConf) *Client {
+	return &Client{
+		name:    name,
+		conf:    conf,
+		http:    &http.Client{},
+		breaker: breaker{threshold: conf.BreakerThreshold, cooldown: conf.BreakerCooldown},
+	}
+}
+
+// Do sends the request and returns the response of the service, or an error if the request failed,
+// the service answered with a non 2xx status (a *StatusError), or the circuit breaker is open
+func (c *Client) Do(ctx context.Context, req Request) (*Response, error) {
+	attempts := 1
+	if req.Idempotent {
+		attempts += c.conf.Retries
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, c.backoff(attempt)); err != nil {
+				return nil, err
+			}
+		}
+		if !c.breaker.allow() {
+			return nil, fmt.Errorf("%v: %w", c.name, ErrCircuitOpen)
+		}
+
+		var resp *Response
+		resp, err = c.send(ctx, req)
+		if err == nil {
+			c.breaker.success()
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			// cancelled by the caller, not a failure of the service
+			c.breaker.cancelled()
+			return nil, err
+		}
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode < 500 && statusErr.StatusCode != http.StatusTooManyRequests {
+			// the service is healthy, the request is not
+			c.breaker.success()
+			return nil, err
+		}
+		c.breaker.failure()
+	}
+	return nil, err
+}
+
+// DoJSON sends the request and decodes the JSON body of the response into v
+func (c *Client) DoJSON(ctx context.Context, req Request, v interface{}) error {
+	resp, err := c.Do(ctx, req)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(resp.Body, v); err != nil {
+		return fmt.Errorf("%v: %w: %v", c.name, ErrDecode, err)
+	}
+	return nil
+}
+
+// send makes a single attempt of the request
+func (c *Client) send(ctx context.Context, req Request) (*Response, error) {
+	timeout := c.conf.Timeout
+	if req.Timeout > 0 {
+		timeout = req.Timeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var body io.Reader
+	if req.Body != nil {
+		body = bytes.NewReader(req.Body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.Method, req.Url, body)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Close = true
+	if req.ContentType != "" {
+		httpReq.Header.Set("Content-Type", req.ContentType)
+	}
+
+	httpResp, err := c.http.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	respBody, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if httpResp.StatusCode < 200 || httpResp.StatusCode > 299 {
+		var errMsg struct {
+			Error string `json:"error"`
+		}
+		_ = json.Unmarshal(respBody, &errMsg)
+		return nil, &StatusError{StatusCode: httpResp.StatusCode, Status: httpResp.Status, Message: errMsg.Error}
+	}
+	return &Response{StatusCode: httpResp.StatusCode, Status: httpResp.Status, Body: respBody}, nil
+}
+
+// backoff returns a random wait before the given retry attempt, up to an exponentially growing bound
+func (c *Client) backoff(attempt int) time.Duration {
+	bound := c.conf.BackoffBase << (attempt - 1)
+	if bound <= 0 || (c.conf.BackoffMax > 0 && bound > c.conf.BackoffMax) {
+		bound = c.conf.BackoffMax
+	}
+	if bound <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(bound)) + 1)
+}
+
+// sleep waits for d, or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// breaker is a circuit breaker: it opens after threshold consecutive failures, rejecting requests,
+// then after cooldown lets a single request through, closing again if it succeeds
+type breaker struct {
+	lock      sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow checks if a request can be sent
+func (b *breaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	// half-open, let this request probe the service
+	b.probing = true
+	return true
+}
+
+// success records a request that reached a healthy service
+func (b *breaker) success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures = 0
+	b.probing = false
+}
+
+// cancelled records a request abandoned by its caller, which tells nothing about the service
+func (b *breaker) cancelled() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.probing = false
+}
+
+// failure records a request that failed, opening the breaker once the threshold is reached
+func (b *breaker) failure() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
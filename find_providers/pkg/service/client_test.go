@@ -0,0 +1,261 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// statuses serves the given statuses in turn, the last one once they run out, and counts the requests served
+type statuses struct {
+	statuses []int
+	requests int64
+}
+
+func (s *statuses) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	n := int(atomic.AddInt64(&s.requests, 1))
+	status := s.statuses[len(s.statuses)-1]
+	if n <= len(s.statuses) {
+		status = s.statuses[n-1]
+	}
+	w.WriteHeader(status)
+	if status >= 300 {
+		fmt.Fprintf(w, `{"error": "failed with %v"}`, status)
+	} else {
+		fmt.Fprint(w, `{"cid": "a"}`)
+	}
+}
+
+// testConf retries quickly and never opens the breaker
+var testConf = ClientConf{Timeout: time.Second, Retries: 2, BackoffBase: time.Millisecond, BackoffMax: 2 * time.Millisecond}
+
+func TestRetries(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		statuses   []int
+		idempotent bool
+		requests   int64
+		class      string
+	}{
+		{name: "success", statuses: []int{200}, idempotent: true, requests: 1},
+		{name: "5xx retried", statuses: []int{500, 503, 200}, idempotent: true, requests: 3},
+		{name: "5xx retried until the retries run out", statuses: []int{502}, idempotent: true, requests: 3, class: ErrorClassUnavailable},
+		{name: "429 retried", statuses: []int{429, 200}, idempotent: true, requests: 2},
+		{name: "4xx not retried", statuses: []int{404, 200}, idempotent: true, requests: 1, class: ErrorClassStatus},
+		{name: "not idempotent not retried", statuses: []int{500, 200}, requests: 1, class: ErrorClassUnavailable},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s := &statuses{statuses: c.statuses}
+			server := httptest.NewServer(s)
+			defer server.Close()
+
+			var ans struct{ Cid string }
+			err := NewClient("test", testConf).DoJSON(context.Background(), Request{Method: "GET", Url: server.URL, Idempotent: c.idempotent}, &ans)
+			if class := ErrorClass(err); class != c.class {
+				t.Fatalf("got error %v of class %q, expected %q", err, class, c.class)
+			}
+			if err == nil && ans.Cid != "a" {
+				t.Fatalf("decoded %+v", ans)
+			}
+			if requests := atomic.LoadInt64(&s.requests); requests != c.requests {
+				t.Fatalf("sent %v requests, expected %v", requests, c.requests)
+			}
+		})
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	server := httptest.NewServer(&statuses{statuses: []int{400}})
+	defer server.Close()
+	_, err := NewClient("test", testConf).Do(context.Background(), Request{Method: "GET", Url: server.URL})
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != 400 || statusErr.Message != "failed with 400" {
+		t.Fatalf("got %#v, expected the status and message of the service", err)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	// failing answers 500 and blocks each request until it is released or cancelled
+	var failing int32 = 1
+	var requests int64
+	release := make(chan struct{})
+	blocking := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		if r.URL.Path == "/block" {
+			blocking <- struct{}{}
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient("test", ClientConf{Timeout: time.Second, BreakerThreshold: 2, BreakerCooldown: 50 * time.Millisecond})
+	get := func(path string) error {
+		_, err := c.Do(context.Background(), Request{Method: "GET", Url: server.URL + path})
+		return err
+	}
+	expectRequests := func(expected int64) {
+		t.Helper()
+		if n := atomic.LoadInt64(&requests); n != expected {
+			t.Fatalf("sent %v requests, expected %v", n, expected)
+		}
+	}
+
+	// opens after 2 failures
+	for i := 0; i < 2; i++ {
+		if err := get("/"); ErrorClass(err) != ErrorClassUnavailable || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("got %v, expected the service to fail", err)
+		}
+	}
+	if err := get("/"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v, expected the breaker to be open", err)
+	}
+	expectRequests(2)
+
+	// a failed probe opens it again
+	time.Sleep(60 * time.Millisecond)
+	if err := get("/"); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v, expected the probe to fail", err)
+	}
+	if err := get("/"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v, expected the breaker to open again", err)
+	}
+	expectRequests(3)
+
+	// a single probe goes through while half-open
+	time.Sleep(60 * time.Millisecond)
+	atomic.StoreInt32(&failing, 0)
+	var wg sync.WaitGroup
+	var probeErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		probeErr = get("/block")
+	}()
+	<-blocking
+	if err := get("/"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v, expected only the probe to go through", err)
+	}
+	close(release)
+	wg.Wait()
+	if probeErr != nil {
+		t.Fatalf("got %v, expected the probe to succeed", probeErr)
+	}
+	expectRequests(4)
+
+	// closed after the probe succeeded
+	for i := 0; i < 3; i++ {
+		if err := get("/"); err != nil {
+			t.Fatalf("got %v, expected the breaker to be closed", err)
+		}
+	}
+	expectRequests(7)
+}
+
+func TestBreakerIgnoresClientErrors(t *testing.T) {
+	s := &statuses{statuses: []int{404}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	c := NewClient("test", ClientConf{Timeout: time.Second, BreakerThreshold: 1, BreakerCooldown: time.Minute})
+	for i := 0; i < 3; i++ {
+		if _, err := c.Do(context.Background(), Request{Method: "GET", Url: server.URL}); ErrorClass(err) != ErrorClassStatus {
+			t.Fatalf("got %v, expected a status error", err)
+		}
+	}
+	if requests := atomic.LoadInt64(&s.requests); requests != 3 {
+		t.Fatalf("sent %v requests, expected 3", requests)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			<-r.Context().Done()
+		}
+	}))
+	defer server.Close()
+	conf := testConf
+	conf.BreakerThreshold, conf.BreakerCooldown = 1, time.Minute
+	c := NewClient("test", conf)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.Do(ctx, Request{Method: "GET", Url: server.URL + "/block", Idempotent: true})
+	if ErrorClass(err) != ErrorClassTimeout {
+		t.Fatalf("got %v, expected a timeout", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("retried a request cancelled by the caller")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := c.Do(ctx, Request{Method: "GET", Url: server.URL + "/block"}); ErrorClass(err) != ErrorClassCanceled {
+		t.Fatalf("got %v, expected the request to be canceled", err)
+	}
+
+	// abandoned requests do not open the breaker
+	if _, err := c.Do(context.Background(), Request{Method: "GET", Url: server.URL}); err != nil {
+		t.Fatalf("got %v, expected the breaker to be closed", err)
+	}
+
+	// the timeout of the request bounds each attempt
+	_, err = c.Do(context.Background(), Request{Method: "GET", Url: server.URL + "/block", Timeout: 20 * time.Millisecond})
+	if ErrorClass(err) != ErrorClassTimeout {
+		t.Fatalf("got %v, expected a timeout", err)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "not json")
+	}))
+	defer server.Close()
+	var ans struct{}
+	decodeErr := NewClient("test", testConf).DoJSON(context.Background(), Request{Method: "GET", Url: server.URL}, &ans)
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	_, unreachableErr := NewClient("test", testConf).Do(context.Background(), Request{Method: "GET", Url: closed.URL})
+
+	for _, c := range []struct {
+		name  string
+		err   error
+		class string
+	}{
+		{name: "nil", err: nil, class: ""},
+		{name: "deadline", err: fmt.Errorf("lookup: %w", context.DeadlineExceeded), class: ErrorClassTimeout},
+		{name: "canceled", err: fmt.Errorf("lookup: %w", context.Canceled), class: ErrorClassCanceled},
+		{name: "breaker open", err: fmt.Errorf("test: %w", ErrCircuitOpen), class: ErrorClassUnavailable},
+		{name: "decode", err: decodeErr, class: ErrorClassDecode},
+		{name: "5xx", err: &StatusError{StatusCode: 502}, class: ErrorClassUnavailable},
+		{name: "429", err: &StatusError{StatusCode: 429}, class: ErrorClassUnavailable},
+		{name: "4xx", err: &StatusError{StatusCode: 400}, class: ErrorClassStatus},
+		{name: "unreachable", err: unreachableErr, class: ErrorClassUnavailable},
+		{name: "network timeout", err: &net.DNSError{IsTimeout: true}, class: ErrorClassTimeout},
+		{name: "other", err: errors.New("other"), class: ErrorClassOther},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if class := ErrorClass(c.err); class != c.class {
+				t.Fatalf("got class %q for %v, expected %q", class, c.err, c.class)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// classes of errors returned by a Client
+const (
+	ErrorClassTimeout     = "timeout"
+	ErrorClassCanceled    = "canceled"
+	ErrorClassUnavailable = "unavailable"
+	ErrorClassStatus      = "status"
+	ErrorClassDecode      = "decode"
+	ErrorClassOther       = "other"
+)
+
+// ErrorClass tells why a request failed: it timed out, was canceled, the service could not be reached, was
+// overloaded or its breaker is open (unavailable), answered with an error status or an answer that cannot be decoded
+// Returns an empty class for a nil error
+func ErrorClass(err error) string {
+	var statusErr *StatusError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorClassTimeout
+	case errors.Is(err, context.Canceled):
+		return ErrorClassCanceled
+	case errors.Is(err, ErrCircuitOpen):
+		return ErrorClassUnavailable
+	case errors.Is(err, ErrDecode):
+		return ErrorClassDecode
+	case errors.As(err, &statusErr):
+		if statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests {
+			return ErrorClassUnavailable
+		}
+		return ErrorClassStatus
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return ErrorClassTimeout
+		}
+		return ErrorClassUnavailable
+	default:
+		return ErrorClassOther
+	}
+}
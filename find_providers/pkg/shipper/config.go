@@ -0,0 +1,20 @@
+package shipper
+
+import "time"
+
+// Conf holds the parameters of the gateway log shipper
+type Conf struct {
+	// Paths are the nginx access logs tailed, rotated logs are expected at the same path with a .1 suffix
+	Paths []string `yaml:"paths" toml:"paths"`
+	// StateFile keeps the offsets of the lines shipped, so a restarted shipper resumes where it stopped
+	StateFile string `yaml:"state_file" toml:"state_file"`
+	// FromStart ships the logs without a saved offset from their start instead of their end
+	FromStart bool `yaml:"from_start" toml:"from_start"`
+	// Filter drops the lines that are not GET requests of a cid instead of shipping them
+	Filter bool `yaml:"filter" toml:"filter"`
+	// BatchSize is how many lines are published at once, BatchInterval how long they wait for a batch at most
+	BatchSize     int           `yaml:"batch_size" toml:"batch_size"`
+	BatchInterval time.Duration `yaml:"batch_interval" toml:"batch_interval"`
+	// PollInterval is how often the logs are checked for new lines, rotations and truncations
+	PollInterval time.Duration `yaml:"poll_interval" toml:"poll_interval"`
+}
@@ -0,0 +1,212 @@
+package shipper
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Position is where a log was read up to, the inode finds the log again once it is rotated
+type Position struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// Line is a line of a tailed log, Position is where the line after it starts
+type Line struct {
+	Path     string
+	Text     string
+	Position Position
+}
+
+// follower tails a log, following it across rotations and truncations
+type follower struct {
+	path    string
+	poll    time.Duration
+	file    *os.File
+	reader  *bufio.Reader
+	pos     Position
+	partial []byte
+}
+
+// Follow tails the log at path from pos and sends its lines until ctx is done
+// When the log is rotated the rotated file is read to its end before the new log is read from its start, and when
+// it is truncated it is read again from its start. A log without a position is read from its end, or from its
+// start with fromStart. If the log was rotated since pos, the rotated file is found at path.1 and finished first
+func Follow(ctx context.Context, path string, pos Position, fromStart bool, poll time.Duration, lines chan<- Line) {
+	f := &follower{path: path, poll: poll}
+	if !f.open(ctx, pos, fromStart) {
+		return
+	}
+	defer func() { _ = f.file.Close() }()
+
+	for {
+		if err := f.read(ctx, lines); err != nil {
+			if ctx.Err() == nil {
+				log.Error("Error reading ", f.path, ": ", err)
+			}
+			return
+		}
+		fi, err := os.Stat(f.path)
+		switch {
+		case err != nil:
+			// rotated and not created again yet
+		case inode(fi) != f.pos.Inode:
+			// nginx may have written to the rotated file until it reopened the log
+			if err := f.read(ctx, lines); err != nil {
+				return
+			}
+			f.flushPartial(ctx, lines)
+			log.Infoln("Log", f.path, "was rotated, following the new one")
+			if !f.reopen(0) {
+				return
+			}
+			continue
+		case fi.Size() < f.pos.Offset:
+			log.Infoln("Log", f.path, "was truncated, reading it again from its start")
+			if !f.reopen(0) {
+				return
+			}
+			continue
+		}
+		select {
+		case <-time.After(f.poll):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// open opens the log at pos, or the rotated file still holding pos, waiting for the log to exist
+// Returns false if ctx is done first
+func (f *follower) open(ctx context.Context, pos Position, fromStart bool) bool {
+	for {
+		fi, err := os.Stat(f.path)
+		if err == nil {
+			switch {
+			case pos.Inode == inode(fi):
+				if fi.Size() < pos.Offset {
+					pos.Offset = 0
+				}
+				return f.openFile(f.path, pos.Offset)
+			case pos.Inode != 0:
+				rotated := f.path + ".1"
+				if rfi, err := os.Stat(rotated); err == nil && inode(rfi) == pos.Inode && rfi.Size() >= pos.Offset {
+					log.Infoln("Log", f.path, "was rotated since it was shipped, finishing", rotated, "first")
+					return f.openFile(rotated, pos.Offset)
+				}
+				return f.openFile(f.path, 0)
+			case fromStart:
+				return f.openFile(f.path, 0)
+			default:
+				return f.openFile(f.path, fi.Size())
+			}
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Error("Error opening ", f.path, ": ", err)
+			return false
+		}
+		select {
+		case <-time.After(f.poll):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// openFile opens the file at path and seeks to offset
+func (f *follower) openFile(path string, offset int64) bool {
+	file, err := os.Open(path)
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	var fi os.FileInfo
+	if err == nil {
+		fi, err = file.Stat()
+	}
+	if err != nil {
+		log.Error("Error opening ", path, ": ", err)
+		if file != nil {
+			_ = file.Close()
+		}
+		return false
+	}
+	log.Infoln("Following", path, "from offset", offset)
+	f.file = file
+	f.reader = bufio.NewReader(file)
+	f.pos = Position{Inode: inode(fi), Offset: offset}
+	f.partial = nil
+	return true
+}
+
+// reopen closes the file and opens the log again at offset
+func (f *follower) reopen(offset int64) bool {
+	_ = f.file.Close()
+	return f.openFile(f.path, offset)
+}
+
+// read sends the complete lines up to the end of the file, a line not terminated yet is kept until it is
+// Returns an error if reading fails or ctx is done
+func (f *follower) read(ctx context.Context, lines chan<- Line) error {
+	for {
+		chunk, err := f.reader.ReadBytes('\n')
+		f.partial = append(f.partial, chunk...)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := f.send(ctx, lines); err != nil {
+			return err
+		}
+	}
+}
+
+// flushPartial sends the line left unterminated at the end of a rotated file
+func (f *follower) flushPartial(ctx context.Context, lines chan<- Line) {
+	if len(f.partial) > 0 {
+		_ = f.send(ctx, lines)
+	}
+}
+
+// send sends the pending line and moves past it
+func (f *follower) send(ctx context.Context, lines chan<- Line) error {
+	f.pos.Offset += int64(len(f.partial))
+	text := string(trimNewline(f.partial))
+	f.partial = f.partial[:0]
+	if text == "" {
+		return nil
+	}
+	select {
+	case lines <- Line{Path: f.path, Text: text, Position: f.pos}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// trimNewline removes the line terminator, \n or \r\n
+func trimNewline(b []byte) []byte {
+	if n := len(b); n > 0 && b[n-1] == '\n' {
+		b = b[:n-1]
+		if n := len(b); n > 0 && b[n-1] == '\r' {
+			b = b[:n-1]
+		}
+	}
+	return b
+}
+
+// inode returns the inode of a file, 0 where there are none
+func inode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
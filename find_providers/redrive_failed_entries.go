@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"find_providers/pkg/broker"
+	"find_providers/pkg/config"
+	"find_providers/pkg/db"
+	"find_providers/pkg/model"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+// redrive publishes failed log entries back to the broker topics they were consumed from,
+// so the controller or the writer processes them again
+func main() {
+	stage := pflag.String("stage", "", "only re-drive the entries failed at this stage (parse, lookup, write_entry or write_providers)")
+	limit := pflag.Int("limit", 0, "re-drive at most this many entries (0 re-drives all of them)")
+	conf := config.Default()
+	config.RegisterFlags(pflag.CommandLine, conf)
+	pflag.Parse()
+	if err := config.Load(&conf, pflag.CommandLine, config.Config.ValidateRedrive); err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+
+	n, err := run(conf, *stage, *limit)
+	if err != nil {
+		log.Fatal("Error re-driving failed entries after ", n, " of them: ", err)
+	}
+	log.Infoln("Re-drove", n, "failed entries")
+}
+
+// run re-drives the failed entries of the dead letter of conf, returns how many were re-driven
+// It returns rather than exits on errors so the publishers and the database are closed first
+func run(conf config.Config, stage string, limit int) (int, error) {
+	// entries are published back in confirmed batches of one, which every broker that can be consumed again supports
+	switch conf.Broker.Type {
+	case "file", "ingest":
+		return 0, fmt.Errorf("cannot re-drive to broker.type %v, its entries are not consumed from a topic", conf.Broker.Type)
+	}
+	publishers := map[string]broker.BatchPublisher{}
+	defer func() {
+		for _, p := range publishers {
+			_ = p.Close()
+		}
+	}()
+	redrive := func(f model.FailedEntry) error {
+		p, ok := publishers[f.Source]
+		if !ok {
+			brokerConf := conf.Broker
+			brokerConf.Topic = f.Source
+			p = broker.PrepareBatchPublisher(brokerConf)
+			publishers[f.Source] = p
+		}
+		return p.PublishBatch([][]byte{[]byte(f.Entry)})
+	}
+
+	switch conf.DeadLetter.Type {
+	case "table":
+		dbAPI := db.PrepareDB(conf.Database.Type, conf.Database.DB())
+		defer dbAPI.Close()
+		return dbAPI.RedriveFailedEntries(stage, limit, redrive)
+	case "queue":
+		return redriveQueue(conf, stage, limit, redrive)
+	default:
+		return 0, fmt.Errorf("nothing to re-drive with dead_letter.type %v", conf.DeadLetter.Type)
+	}
+}
+
+// redriveQueue re-drives the failed entries waiting in the dead letter queue, those not matching stage or beyond
+// limit are put back at the end of the queue
+func redriveQueue(conf config.Config, stage string, limit int, redrive func(model.FailedEntry) error) (int, error) {
+	brokerConf := conf.Broker
+	brokerConf.Topic = conf.DeadLetter.Topic
+	queue := broker.PrepareQueue(brokerConf)
+	defer queue.Close()
+
+	// only go through the entries waiting now, not the ones put back
+	waiting, err := queue.Len()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i := 0; i < waiting; i++ {
+		ok, err := queue.Pull(func(body []byte) error {
+			var f model.FailedEntry
+			if err := json.Unmarshal(body, &f); err != nil {
+				log.Warning("Keeping malformed failed entry:", string(body), err)
+				return queue.Publish(body)
+			}
+			if (stage != "" && f.Stage != stage) || (limit > 0 && n >= limit) {
+				return queue.Publish(body)
+			}
+			if err := redrive(f); err != nil {
+				return err
+			}
+			n++
+			return nil
+		})
+		if err != nil || !ok {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"find_providers/pkg/broker"
+	"find_providers/pkg/config"
+	"find_providers/pkg/parser"
+	"find_providers/pkg/shipper"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+// shipBackoffMax bounds the wait before publishing a failed batch again
+const shipBackoffMax = time.Minute
+
+// ship tails the nginx access logs and publishes their lines to the broker topic the controller consumes
+// Offsets are saved only once the broker confirmed the lines before them, so lines are shipped at least once
+func main() {
+	conf := config.Default()
+	config.RegisterFlags(pflag.CommandLine, conf)
+	pflag.Parse()
+	if err := config.Load(&conf, pflag.CommandLine, config.Config.ValidateShipper); err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	switch conf.Broker.Type {
+	case "rabbitmq", "kafka", "nats", "filequeue":
+	default:
+		log.Fatal("Cannot ship logs to the ", conf.Broker.Type, " broker")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	offsets, err := shipper.LoadOffsets(conf.Shipper.StateFile)
+	if err != nil {
+		log.Fatal("Error loading shipped offsets: ", err)
+	}
+	publisher := broker.PrepareBatchPublisher(conf.Broker)
+	defer publisher.Close()
+
+	lines := make(chan shipper.Line, conf.Shipper.BatchSize)
+	var followers sync.WaitGroup
+	for _, path := range conf.Shipper.Paths {
+		followers.Add(1)
+		go func(path string) {
+			defer followers.Done()
+			shipper.Follow(ctx, path, offsets[path], conf.Shipper.FromStart, conf.Shipper.PollInterval, lines)
+		}(path)
+	}
+	go func() {
+		followers.Wait()
+		close(lines)
+	}()
+
+	batch := make([][]byte, 0, conf.Shipper.BatchSize)
+	// positions of the lines in the batch, saved once it is published
+	positions := map[string]shipper.Position{}
+	shipped, filtered := 0, 0
+	flush := func() bool {
+		if len(batch) > 0 && !publish(ctx, publisher, batch) {
+			return false
+		}
+		shipped += len(batch)
+		batch = batch[:0]
+		if len(positions) == 0 {
+			return true
+		}
+		for path, pos := range positions {
+			offsets[path] = pos
+		}
+		positions = map[string]shipper.Position{}
+		if err := shipper.SaveOffsets(conf.Shipper.StateFile, offsets); err != nil {
+			log.Warning("Error saving shipped offsets:", err)
+		}
+		return true
+	}
+
+	ticker := time.NewTicker(conf.Shipper.BatchInterval)
+	defer ticker.Stop()
+	statsTicker := time.NewTicker(time.Minute)
+	defer statsTicker.Stop()
+	log.Infoln("Shipping", conf.Shipper.Paths, "to", conf.Broker.Type, "topic", conf.Broker.Topic)
+loop:
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				break loop
+			}
+			positions[line.Path] = line.Position
+			if conf.Shipper.Filter {
+				if _, err := parser.ParseEntry(line.Text); errors.Is(err, parser.ErrNotGet) || errors.Is(err, parser.ErrNoCid) {
+					filtered++
+					continue
+				}
+			}
+			batch = append(batch, []byte(line.Text))
+			if len(batch) < conf.Shipper.BatchSize {
+				continue
+			}
+			if !flush() {
+				break loop
+			}
+		case <-ticker.C:
+			if !flush() {
+				break loop
+			}
+		case <-statsTicker.C:
+			log.Infoln("Shipped", shipped, "log lines, filtered", filtered)
+		}
+	}
+
+	// the followers stopped, ship what they read last, once as ctx is done
+	if pending := len(batch); !flush() {
+		log.Warning("Error publishing the last ", pending, " log lines, they are shipped again on restart")
+	}
+	log.Infoln("Stopped, shipped", shipped, "log lines, filtered", filtered)
+}
+
+// publish publishes the batch, again after a growing backoff while it fails
+// Returns false if ctx is done before the batch is published
+func publish(ctx context.Context, publisher broker.BatchPublisher, batch [][]byte) bool {
+	backoff := time.Second
+	for {
+		err := publisher.PublishBatch(batch)
+		if err == nil {
+			return true
+		}
+		log.Warning("Error publishing ", len(batch), " log lines, retrying in ", backoff, ": ", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return false
+		}
+		backoff *= 2
+		if backoff > shipBackoffMax {
+			backoff = shipBackoffMax
+		}
+	}
+}
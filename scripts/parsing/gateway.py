@@ -143,13 +143,13 @@ def parse_log_entry(log_entry: str) -> dict[str, str]:
 
     upstream_response_time, upstream_header_time = [], []
     while tokens[i][-1] == ',':
-        upstream_response_time.append(tokens[i][-1])
+        upstream_response_time.append(tokens[i][:-1])
         i += 1
 
     upstream_response_time.append(tokens[i])
     i += 1
     while tokens[i][-1] == ',':
-        upstream_header_time.append(tokens[i][-1])
+        upstream_header_time.append(tokens[i][:-1])
         i += 1
 
     upstream_header_time.append(tokens[i])
@@ -12,7 +12,8 @@ args = parser.parse_args()
 connection = pika.BlockingConnection(pika.ConnectionParameters(args.host))
 channel = connection.channel()
 
-channel.queue_declare(queue=args.topic)
+# durable, as the consumers declare it
+channel.queue_declare(queue=args.topic, durable=True)
 
 print("Connected to Server!")
 
@@ -21,7 +22,8 @@ for line in sys.stdin:
     line = line.rstrip()
     channel.basic_publish(exchange='',
                           routing_key=args.topic,
-                          body=line)
+                          body=line,
+                          properties=pika.BasicProperties(delivery_mode=2))
 
 
 